@@ -4,6 +4,7 @@
 package main // import "mvdan.cc/sh/cmd/gosh"
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
@@ -65,12 +66,8 @@ func runPath(path string) error {
 }
 
 func run(reader io.Reader, name string) error {
-	prog, err := parser.Parse(reader, name)
-	if err != nil {
-		return err
-	}
 	runner.Reset()
-	return runner.Run(prog)
+	return runner.RunReader(context.Background(), reader, name)
 }
 
 type promptReader struct {
@@ -91,7 +88,7 @@ func (pr *promptReader) Read(p []byte) (int, error) {
 func interactive() error {
 	r := &promptReader{os.Stdin, true}
 	runner.Reset()
-	fn := func(s *syntax.Stmt) {
+	fn := func(s *syntax.Stmt) bool {
 		if err := runner.Stmt(s); err != nil {
 			code, ok := err.(interp.ExitCode)
 			if ok {
@@ -101,6 +98,7 @@ func interactive() error {
 			os.Exit(1)
 		}
 		r.first = true
+		return true
 	}
 	return parser.Stmts(r, fn)
 }
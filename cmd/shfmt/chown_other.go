@@ -0,0 +1,11 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build windows plan9
+
+package main
+
+import "os"
+
+// chownLike does nothing, as ownership is not supported.
+func chownLike(path string, info os.FileInfo) error { return nil }
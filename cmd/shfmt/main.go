@@ -8,11 +8,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
 
 	"mvdan.cc/sh/fileutil"
+	"mvdan.cc/sh/internal/typedjson"
 	"mvdan.cc/sh/syntax"
 )
 
@@ -25,6 +27,10 @@ var (
 	indent      = flag.Uint("i", 0, "indent: 0 for tabs (default), >0 for number of spaces")
 	binNext     = flag.Bool("bn", false, "binary ops like && and | may start a line")
 	caseIndent  = flag.Bool("ci", false, "switch cases will be indented")
+	spaceRedirs = flag.Bool("sr", false, "redirect operators will be followed by a space")
+	redirsLast  = flag.Bool("rl", false, "redirects will be moved after the arguments")
+	redirFds    = flag.String("fd", "", "redirect fds like 1 in 1>file: omit, explicit or unset to keep")
+	filename    = flag.String("filename", "", "filename to use for stdin in errors and language detection")
 	toJSON      = flag.Bool("exp.tojson", false, "print AST to stdout as a typed JSON")
 	showVersion = flag.Bool("version", false, "show version and exit")
 
@@ -32,8 +38,14 @@ var (
 	printer           *syntax.Printer
 	readBuf, writeBuf bytes.Buffer
 
+	// detectLang is set if no language was given, so that it may be
+	// picked from each file name
+	detectLang  bool
+	langParsers = map[syntax.LangVariant]*syntax.Parser{}
+
 	copyBuf = make([]byte, 32*1024)
 
+	in  io.Reader = os.Stdin
 	out io.Writer = os.Stdout
 
 	version = "v2.0.0"
@@ -50,10 +62,14 @@ func main() {
 
   -ln str   language variant to parse (bash/posix/mksh, default "bash")
   -p        shorthand for -ln=posix
+  -filename str  filename to use for stdin in errors and language detection
 
   -i uint   indent: 0 for tabs (default), >0 for number of spaces
   -bn       binary ops like && and | may start a line
   -ci       switch cases will be indented
+  -sr       redirect operators will be followed by a space
+  -rl       redirects will be moved after the arguments
+  -fd str   redirect fds like 1 in 1>file (omit/explicit, default keep)
 
   -exp.tojson  print AST to stdout as a typed JSON
 `)
@@ -69,6 +85,7 @@ func main() {
 		os.Exit(1)
 	}
 	lang := syntax.LangBash
+	detectLang = *langStr == "" && !*posix
 	switch *langStr {
 	case "bash", "":
 	case "posix":
@@ -82,6 +99,17 @@ func main() {
 	if *posix {
 		lang = syntax.LangPOSIX
 	}
+	fdStyle := syntax.FdsAsWritten
+	switch *redirFds {
+	case "":
+	case "omit":
+		fdStyle = syntax.FdsOmitted
+	case "explicit":
+		fdStyle = syntax.FdsExplicit
+	default:
+		fmt.Fprintf(os.Stderr, "unknown redirect fd style: %s\n", *redirFds)
+		os.Exit(1)
+	}
 	parser = syntax.NewParser(syntax.KeepComments, syntax.Variant(lang))
 	printer = syntax.NewPrinter(func(p *syntax.Printer) {
 		syntax.Indent(*indent)(p)
@@ -91,6 +119,13 @@ func main() {
 		if *caseIndent {
 			syntax.SwitchCaseIndent(p)
 		}
+		if *spaceRedirs {
+			syntax.SpaceRedirects(p)
+		}
+		if *redirsLast {
+			syntax.RedirectsLast(p)
+		}
+		syntax.RedirectFds(fdStyle)(p)
 	})
 	if flag.NArg() == 0 {
 		if err := formatStdin(); err != nil {
@@ -119,7 +154,7 @@ func formatStdin() error {
 	if *write || *list {
 		return fmt.Errorf("-w and -l can only be used on files")
 	}
-	prog, err := parser.Parse(os.Stdin, "")
+	prog, err := parserFor(*filename).Parse(in, *filename)
 	if err != nil {
 		return err
 	}
@@ -127,11 +162,34 @@ func formatStdin() error {
 		syntax.Simplify(prog)
 	}
 	if *toJSON {
-		return writeJSON(out, prog, true)
+		return typedjson.Encode(out, prog, true)
 	}
 	return printer.Print(out, prog)
 }
 
+// parserFor returns the parser to use for a file name. Unless a language
+// was given, the file extension may imply one.
+func parserFor(name string) *syntax.Parser {
+	if !detectLang {
+		return parser
+	}
+	var lang syntax.LangVariant
+	switch filepath.Ext(name) {
+	case ".bash":
+		lang = syntax.LangBash
+	case ".mksh":
+		lang = syntax.LangMirBSDKorn
+	default:
+		return parser
+	}
+	p := langParsers[lang]
+	if p == nil {
+		p = syntax.NewParser(syntax.KeepComments, syntax.Variant(lang))
+		langParsers[lang] = p
+	}
+	return p
+}
+
 var vcsDir = regexp.MustCompile(`^\.(git|svn|hg)$`)
 
 func walk(path string, onError func(error)) {
@@ -191,7 +249,7 @@ func formatPath(path string, checkShebang bool) error {
 		return err
 	}
 	src := readBuf.Bytes()
-	prog, err := parser.Parse(&readBuf, path)
+	prog, err := parserFor(path).Parse(&readBuf, path)
 	if err != nil {
 		return err
 	}
@@ -208,16 +266,12 @@ func formatPath(path string, checkShebang bool) error {
 			}
 		}
 		if *write {
-			if err := f.Truncate(0); err != nil {
-				return err
-			}
-			if _, err := f.Seek(0, io.SeekStart); err != nil {
+			info, err := f.Stat()
+			if err != nil {
 				return err
 			}
-			if _, err := f.Write(res); err != nil {
-				return err
-			}
-			if err := f.Close(); err != nil {
+			f.Close()
+			if err := writeAtomic(path, info, res); err != nil {
 				return err
 			}
 		}
@@ -229,3 +283,54 @@ func formatPath(path string, checkShebang bool) error {
 	}
 	return nil
 }
+
+// writeAtomic replaces the contents of a file. It writes to a temporary
+// file in the same directory first and then renames it over the
+// original, so that the file is never left half-written. The mode and
+// ownership of the file are kept; if the latter isn't possible, the
+// file is written in place instead.
+func writeAtomic(path string, info os.FileInfo, data []byte) error {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real // don't replace symlinks with files
+	}
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, "."+base+".shfmt")
+	if err != nil {
+		return writeInPlace(path, data)
+	}
+	_, err = tmp.Write(data)
+	if err2 := tmp.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), info.Mode().Perm())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := chownLike(tmp.Name(), info); err != nil {
+		os.Remove(tmp.Name())
+		return writeInPlace(path, data)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+func writeInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 
 	"mvdan.cc/sh/syntax"
@@ -152,3 +153,87 @@ func TestWalk(t *testing.T) {
 		t.Fatal("`shfmt nowrite` did not error")
 	}
 }
+
+func TestStdinFilename(t *testing.T) {
+	parser = syntax.NewParser(syntax.KeepComments)
+	printer = syntax.NewPrinter()
+	defer func() {
+		in, out = os.Stdin, os.Stdout
+		*filename, detectLang = "", false
+	}()
+	var outBuf bytes.Buffer
+	out = &outBuf
+	*list, *write = false, false
+	detectLang = true
+
+	in = strings.NewReader("echo ${ foo;}\n")
+	*filename = "input.mksh"
+	if err := formatStdin(); err != nil {
+		t.Fatalf("mksh was not detected from -filename: %v", err)
+	}
+	if want := "echo ${ foo;}\n"; outBuf.String() != want {
+		t.Fatalf("wrong output:\nwant: %q\ngot:  %q", want, outBuf.String())
+	}
+
+	in = strings.NewReader("echo ${ foo;}\n")
+	*filename = "input.bash"
+	err := formatStdin()
+	if err == nil {
+		t.Fatal("bash did not reject mksh syntax")
+	}
+	if !strings.HasPrefix(err.Error(), "input.bash:1:") {
+		t.Fatalf("-filename not used in error: %v", err)
+	}
+}
+
+func TestWriteAtomic(t *testing.T) {
+	parser = syntax.NewParser(syntax.KeepComments)
+	printer = syntax.NewPrinter()
+	dir, err := ioutil.TempDir("", "shfmt-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.sh")
+	if err := ioutil.WriteFile(path, []byte(" foo"), 0740); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, 0740); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.sh")
+	if err := os.Symlink("a.sh", link); err != nil {
+		t.Fatal(err)
+	}
+	*list, *write = false, true
+	defer func() { *write = false }()
+	if err := formatPath(link, false); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "foo\n"; string(body) != want {
+		t.Fatalf("wrong contents:\nwant: %q\ngot:  %q", want, body)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0740 {
+		t.Fatalf("mode not kept: want 0740, got %#o", mode)
+	}
+	if info, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("symlink was replaced by a file")
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("temporary files were left behind: %d files", len(names))
+	}
+}
@@ -0,0 +1,308 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// shplay is an HTTP server for a shell playground, much like the Go
+// playground. It parses, formats and interprets the shell programs sent
+// to it.
+//
+// All endpoints take a POST request with a JSON object, and reply with
+// another JSON object:
+//
+//	/parse   returns the syntax tree of Source as AST
+//	/format  returns Source formatted as Output
+//	/run     interprets Source, returning its Output and Exit status
+//
+// Programs are run without access to other programs, and the files they
+// open are kept in memory and discarded once they finish. Note that
+// some features, such as globbing and file tests, still look at the
+// server's filesystem.
+package main // import "mvdan.cc/sh/cmd/shplay"
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/internal/typedjson"
+	"mvdan.cc/sh/interp"
+	"mvdan.cc/sh/syntax"
+)
+
+var (
+	httpAddr  = flag.String("http", "localhost:8080", "HTTP service address")
+	timeout   = flag.Duration("timeout", 5*time.Second, "maximum duration of each run")
+	maxOutput = flag.Int("maxoutput", 1<<20, "maximum output size of each run, in bytes")
+)
+
+const (
+	maxRequest = 1 << 20
+	maxDepth   = 1000
+)
+
+// request is the body of a request to any of the endpoints.
+type request struct {
+	Source string
+	Lang   string // bash (default), posix or mksh
+
+	// /format only
+	Simplify         bool
+	Indent           uint
+	BinaryNextLine   bool
+	SwitchCaseIndent bool
+
+	// /run only
+	Stdin string
+}
+
+// response is the body of a reply from any of the endpoints.
+type response struct {
+	// Error is set if the program could not be parsed, or if it
+	// could not be run to completion. Line and Col are set too if
+	// the error has a position.
+	Error     string `json:",omitempty"`
+	Line, Col uint   `json:",omitempty"`
+
+	AST    json.RawMessage `json:",omitempty"` // /parse
+	Output string          `json:",omitempty"` // /format, /run
+	Exit   int             `json:",omitempty"` // /run
+}
+
+func main() {
+	flag.Parse()
+	http.Handle("/parse", handler(parse))
+	http.Handle("/format", handler(format))
+	http.Handle("/run", handler(run))
+	log.Fatal(http.ListenAndServe(*httpAddr, nil))
+}
+
+func handler(fn func(req *request, resp *response)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req request
+		dec := json.NewDecoder(io.LimitReader(r.Body, maxRequest))
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		var resp response
+		fn(&req, &resp)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&resp)
+	})
+}
+
+func (resp *response) setErr(err error) {
+	resp.Error = err.Error()
+	if pe, ok := err.(interface {
+		Line() uint
+		Col() uint
+	}); ok {
+		resp.Line, resp.Col = pe.Line(), pe.Col()
+	}
+}
+
+func parseSource(req *request, resp *response) *syntax.File {
+	lang := syntax.LangBash
+	switch req.Lang {
+	case "bash", "":
+	case "posix":
+		lang = syntax.LangPOSIX
+	case "mksh":
+		lang = syntax.LangMirBSDKorn
+	default:
+		resp.Error = fmt.Sprintf("unknown shell language: %s", req.Lang)
+		return nil
+	}
+	parser := syntax.NewParser(syntax.KeepComments, syntax.Variant(lang),
+		syntax.MaxDepth(maxDepth), syntax.MaxSize(maxRequest))
+	f, err := parser.Parse(strings.NewReader(req.Source), "")
+	if err != nil {
+		resp.setErr(err)
+		return nil
+	}
+	return f
+}
+
+func parse(req *request, resp *response) {
+	f := parseSource(req, resp)
+	if f == nil {
+		return
+	}
+	var buf bytes.Buffer
+	if err := typedjson.Encode(&buf, f, false); err != nil {
+		resp.setErr(err)
+		return
+	}
+	resp.AST = buf.Bytes()
+}
+
+func format(req *request, resp *response) {
+	f := parseSource(req, resp)
+	if f == nil {
+		return
+	}
+	if req.Simplify {
+		syntax.Simplify(f)
+	}
+	printer := syntax.NewPrinter(func(p *syntax.Printer) {
+		syntax.Indent(req.Indent)(p)
+		if req.BinaryNextLine {
+			syntax.BinaryNextLine(p)
+		}
+		if req.SwitchCaseIndent {
+			syntax.SwitchCaseIndent(p)
+		}
+	})
+	var buf bytes.Buffer
+	if err := printer.Print(&buf, f); err != nil {
+		resp.setErr(err)
+		return
+	}
+	resp.Output = buf.String()
+}
+
+func run(req *request, resp *response) {
+	f := parseSource(req, resp)
+	if f == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	out := &limitWriter{max: *maxOutput, full: cancel}
+	fs := &memFS{files: make(map[string]*bytes.Buffer)}
+	r := interp.Runner{
+		Env:            []string{"HOME=/", "PWD=/"},
+		Dir:            "/",
+		Stdin:          strings.NewReader(req.Stdin),
+		Stdout:         out,
+		Stderr:         out,
+		Context:        ctx,
+		WaitBackground: true,
+		Open:           interp.OpenDevImpls(fs.open),
+		Exec: func(ctx interp.Ctxt, name string, args []string) error {
+			fmt.Fprintf(ctx.Stderr, "%s: programs are not available\n", name)
+			return interp.ExitCode(127)
+		},
+	}
+	if err := r.Reset(); err != nil {
+		resp.setErr(err)
+		return
+	}
+	err := r.Run(f)
+	resp.Output = out.String()
+	switch x := err.(type) {
+	case nil:
+	case interp.ExitCode:
+		resp.Exit = int(x)
+	default:
+		resp.Exit = 1
+		switch {
+		case out.exceeded():
+			resp.Error = "output limit exceeded"
+		case err == context.DeadlineExceeded:
+			resp.Error = "timed out"
+		default:
+			resp.setErr(err)
+		}
+	}
+}
+
+// limitWriter keeps up to max bytes written to it, calling full once
+// any more are written.
+type limitWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	max  int
+	over bool
+	full func()
+}
+
+func (w *limitWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if left := w.max - w.buf.Len(); len(p) > left {
+		w.buf.Write(p[:left])
+		if !w.over {
+			w.over = true
+			w.full()
+		}
+		return left, io.ErrShortWrite
+	}
+	return w.buf.Write(p)
+}
+
+func (w *limitWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+func (w *limitWriter) exceeded() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.over
+}
+
+// memFS is a filesystem kept in memory, used to open files on behalf of
+// a program being run. Its total size is limited like the output.
+type memFS struct {
+	mu    sync.Mutex
+	files map[string]*bytes.Buffer
+	size  int
+}
+
+func (fs *memFS) open(ctx interp.Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	buf, ok := fs.files[path]
+	switch {
+	case flag&os.O_CREATE != 0 && (!ok || flag&os.O_TRUNC != 0):
+		if ok {
+			fs.size -= buf.Len()
+		}
+		buf = new(bytes.Buffer)
+		fs.files[path] = buf
+	case !ok:
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		// readers get a copy of the contents at the time of opening
+		return memFile{fs: fs, buf: bytes.NewBuffer(append([]byte(nil), buf.Bytes()...))}, nil
+	}
+	return memFile{fs: fs, buf: buf}, nil
+}
+
+type memFile struct {
+	fs  *memFS
+	buf *bytes.Buffer
+}
+
+func (f memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.buf.Read(p)
+}
+
+func (f memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.size+len(p) > *maxOutput {
+		return 0, fmt.Errorf("no space left in memory")
+	}
+	f.fs.size += len(p)
+	return f.buf.Write(p)
+}
+
+func (f memFile) Close() error { return nil }
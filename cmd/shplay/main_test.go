@@ -0,0 +1,91 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func init() {
+	*timeout = time.Second
+	*maxOutput = 100
+}
+
+var playTests = []struct {
+	path string
+	req  request
+	want response
+}{
+	{"/parse", request{Source: "foo"}, response{
+		AST: json.RawMessage(`{"StmtList":{"Stmts":[{"Cmd":{"Args":[{"Parts":[{"Type":"Lit","Value":"foo"}]}],"Type":"CallExpr"}}]}}`),
+	}},
+	{"/parse", request{Source: "foo("}, response{
+		Error: "1:1: \"foo(\" must be followed by )", Line: 1, Col: 1,
+	}},
+	{"/parse", request{Source: "foo", Lang: "zsh"}, response{
+		Error: "unknown shell language: zsh",
+	}},
+	{"/format", request{Source: "if a;then b;fi"}, response{
+		Output: "if a; then b; fi\n",
+	}},
+	{"/format", request{Source: "foo &&\nbar", Indent: 2, BinaryNextLine: true}, response{
+		Output: "foo \\\n  && bar\n",
+	}},
+	{"/run", request{Source: "read a; echo $a", Stdin: "foo\n"}, response{
+		Output: "foo\n",
+	}},
+	{"/run", request{Source: "echo foo >/f; echo bar >>/f; while read l; do echo \"<$l>\"; done </f; exit 3"}, response{
+		Output: "<foo>\n<bar>\n", Exit: 3,
+	}},
+	{"/run", request{Source: "ls /"}, response{
+		Output: "ls: programs are not available\n", Exit: 127,
+	}},
+	{"/run", request{Source: "while true; do :; done"}, response{
+		Error: "timed out", Exit: 1,
+	}},
+	{"/run", request{Source: "while true; do echo foo; done"}, response{
+		Output: "foo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\nfoo\n",
+		Error:  "output limit exceeded", Exit: 1,
+	}},
+}
+
+func TestHandlers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/parse", handler(parse))
+	mux.Handle("/format", handler(format))
+	mux.Handle("/run", handler(run))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	for _, tc := range playTests {
+		body, _ := json.Marshal(tc.req)
+		res, err := http.Post(srv.URL+tc.path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got response
+		err = json.NewDecoder(res.Body).Decode(&got)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tc.want)
+		if !bytes.Equal(gotJSON, wantJSON) {
+			t.Errorf("%s %q:\nwant: %s\ngot:  %s", tc.path, tc.req.Source, wantJSON, gotJSON)
+		}
+	}
+	res, err := http.Get(srv.URL + "/run")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("want status %d for GET, got %d", http.StatusMethodNotAllowed, res.StatusCode)
+	}
+}
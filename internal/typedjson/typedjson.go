@@ -1,7 +1,9 @@
 // Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
 // See LICENSE for licensing information
 
-package main
+// Package typedjson encodes shell syntax trees as JSON, adding the name
+// of each node's type where the Go types alone would be ambiguous.
+package typedjson // import "mvdan.cc/sh/internal/typedjson"
 
 import (
 	"encoding/json"
@@ -12,7 +14,10 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
-func writeJSON(w io.Writer, f *syntax.File, pretty bool) error {
+// Encode writes the JSON encoding of f to w, followed by a newline.
+// Node positions are omitted, as are fields with zero values. If pretty
+// is true, the output is indented with tabs.
+func Encode(w io.Writer, f *syntax.File, pretty bool) error {
 	v, _ := recurse(reflect.ValueOf(f))
 	enc := json.NewEncoder(w)
 	if pretty {
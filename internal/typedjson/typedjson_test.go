@@ -1,7 +1,7 @@
 // Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
 // See LICENSE for licensing information
 
-package main
+package typedjson
 
 import (
 	"bytes"
@@ -11,7 +11,7 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
-func TestWriteJSON(t *testing.T) {
+func TestEncode(t *testing.T) {
 	in := `cmd arg1 "arg2"`
 	want := `{"StmtList":{"Stmts":[{"Cmd":{"Args":[{"Parts":[{"Type":"Lit","Value":"cmd"}]},{"Parts":[{"Type":"Lit","Value":"arg1"}]},{"Parts":[{"Parts":[{"Type":"Lit","Value":"arg2"}],"Type":"DblQuoted"}]}],"Type":"CallExpr"}}]}}`
 	parser := syntax.NewParser(syntax.KeepComments)
@@ -20,7 +20,7 @@ func TestWriteJSON(t *testing.T) {
 		t.Fatal(err)
 	}
 	var buf bytes.Buffer
-	writeJSON(&buf, prog, false)
+	Encode(&buf, prog, false)
 	got := buf.String()
 	if got != want+"\n" {
 		t.Fatalf("wrong output for %q\nwant: %s\ngot:  %s", in, want, got)
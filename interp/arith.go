@@ -9,6 +9,23 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
+// EvalArithm evaluates an arithmetic expression, such as one parsed
+// with syntax.Parser.Arithmetic, following the same rules as the
+// interpreter does for $((expr)). It does not need a program to be
+// run, so it can be used by Go code that reuses the shell arithmetic
+// syntax.
+//
+// Variables are read from vars, including those whose names are the
+// values of other variables. Expansions that would run commands, such
+// as command substitutions, result in an error.
+func EvalArithm(expr syntax.ArithmExpr, vars Vars) (int, error) {
+	var n int
+	err := evalExpr(expr, vars, "an arithmetic expression", nil, func(r *Runner) {
+		n = r.arithm(expr)
+	})
+	return n, err
+}
+
 func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 	switch x := expr.(type) {
 	case *syntax.Word:
@@ -28,15 +45,15 @@ func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 	case *syntax.UnaryArithm:
 		switch x.Op {
 		case syntax.Inc, syntax.Dec:
-			name := x.X.(*syntax.Word).Parts[0].(*syntax.Lit).Value
-			old := atoi(r.getVar(name))
+			name, index := r.arithmRef(x.X)
+			old := atoi(r.refValue(name, index))
 			val := old
 			if x.Op == syntax.Inc {
 				val++
 			} else {
 				val--
 			}
-			r.setVar(name, nil, strconv.Itoa(val))
+			r.setVar(name, index, strconv.Itoa(val))
 			if x.Post {
 				return old
 			}
@@ -81,8 +98,8 @@ func atoi(s string) int {
 }
 
 func (r *Runner) assgnArit(b *syntax.BinaryArithm) int {
-	name := b.X.(*syntax.Word).Parts[0].(*syntax.Lit).Value
-	val := atoi(r.getVar(name))
+	name, index := r.arithmRef(b.X)
+	val := atoi(r.refValue(name, index))
 	arg := r.arithm(b.Y)
 	switch b.Op {
 	case syntax.Assgn:
@@ -108,10 +125,32 @@ func (r *Runner) assgnArit(b *syntax.BinaryArithm) int {
 	case syntax.ShrAssgn:
 		val >>= uint(arg)
 	}
-	r.setVar(name, nil, strconv.Itoa(val))
+	r.setVar(name, index, strconv.Itoa(val))
 	return val
 }
 
+// arithmRef returns the variable that an arithmetic expression assigns
+// to, such as "a" or "a[i++]". The index is evaluated right away, so
+// that its side effects only happen once.
+func (r *Runner) arithmRef(expr syntax.ArithmExpr) (string, *varIndex) {
+	switch x := expr.(*syntax.Word).Parts[0].(type) {
+	case *syntax.ParamExp:
+		return x.Param.Value, r.evalIndex(x.Param.Value, x.Index)
+	case *syntax.Lit:
+		return x.Value, nil
+	}
+	r.runErr(expr.Pos(), "unexpected arithm assignment: %s", expr)
+	return "", nil
+}
+
+func (r *Runner) refValue(name string, index *varIndex) string {
+	if index == nil {
+		return r.getVar(name)
+	}
+	val, _ := r.lookupVar(name)
+	return indexValue(val, index)
+}
+
 func intPow(a, b int) int {
 	p := 1
 	for b > 0 {
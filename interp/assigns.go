@@ -0,0 +1,120 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// Assignments evaluates the variable assignments in a file without
+// running any commands, and returns the resulting values. It is meant
+// to safely read files like .env files or shell profiles.
+//
+// Only top-level statements made up solely of assignments are
+// evaluated, such as "foo=bar" or "export foo=bar"; any other statement
+// is skipped. Expansions are performed, so values may refer to earlier
+// assignments or to the variables in env, but those that would run
+// commands, such as command substitutions, result in an error, as do
+// assignments that fail, such as to a read-only variable. Unlike
+// with Runner.Env, a nil env means an empty environment.
+//
+// The returned map holds the variables assigned by the file that have
+// string values, so arrays are not included.
+func Assignments(f *syntax.File, env []string) (map[string]string, error) {
+	var names []string
+	safe := &syntax.File{Name: f.Name}
+	for _, st := range f.Stmts {
+		var assigns []*syntax.Assign
+		switch x := st.Cmd.(type) {
+		case *syntax.CallExpr:
+			if len(x.Args) > 0 {
+				continue
+			}
+			assigns = x.Assigns
+		case *syntax.DeclClause:
+			switch x.Variant.Value {
+			case "export", "readonly", "declare", "typeset":
+			default:
+				continue
+			}
+			assigns = x.Assigns
+		default:
+			continue
+		}
+		if st.Negated || st.Background || st.Coprocess || len(st.Redirs) > 0 {
+			continue
+		}
+		if err := noCommands(st, f.Name); err != nil {
+			return nil, err
+		}
+		for _, as := range assigns {
+			names = append(names, as.Name.Value)
+		}
+		safe.Stmts = append(safe.Stmts, st)
+	}
+	var stderr bytes.Buffer
+	r := Runner{
+		Env:    env,
+		Stdin:  devNull{},
+		Stdout: ioutil.Discard,
+		Stderr: &stderr,
+		Exec: func(ctx Ctxt, name string, args []string) error {
+			return fmt.Errorf("cannot run %q while evaluating assignments", name)
+		},
+		Open: func(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			return nil, fmt.Errorf("cannot open %q while evaluating assignments", path)
+		},
+	}
+	if env == nil {
+		r.Env = []string{}
+	}
+	if err := r.Reset(); err != nil {
+		return nil, err
+	}
+	if err := r.Run(safe); err != nil {
+		if _, ok := err.(ExitCode); !ok {
+			return nil, err
+		}
+	}
+	if stderr.Len() > 0 {
+		// an assignment failed, e.g. via ${foo?}
+		return nil, fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+	vars := make(map[string]string, len(names))
+	for _, name := range names {
+		if val, ok := r.lookupVar(name); ok {
+			if s, ok := val.(string); ok {
+				vars[name] = s
+			}
+		}
+	}
+	return vars, nil
+}
+
+// noCommands returns an error if a node contains any expansions that
+// would run commands, such as command substitutions.
+func noCommands(node syntax.Node, filename string) error {
+	var err error
+	syntax.Walk(node, func(node syntax.Node) bool {
+		switch node.(type) {
+		case *syntax.CmdSubst, *syntax.ProcSubst:
+			if err == nil {
+				err = RunError{
+					Filename: filename,
+					Pos:      node.Pos(),
+					Text:     "commands cannot be run in this context",
+				}
+			}
+		}
+		return err == nil
+	})
+	return err
+}
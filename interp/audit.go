@@ -0,0 +1,222 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEvent is a single event logged by an AuditLog. Fields with zero
+// values are omitted from its JSON encoding.
+type AuditEvent struct {
+	Time time.Time
+	Op   string // "exec" or "open"
+	Dir  string
+
+	// exec only
+	Args     []string          `json:",omitempty"` // the program name followed by its arguments
+	EnvSet   map[string]string `json:",omitempty"` // variables added or changed from the base
+	EnvUnset []string          `json:",omitempty"` // variables removed from the base
+	Exit     int               `json:",omitempty"`
+	Stdout   int64             `json:",omitempty"` // bytes written
+	Stderr   int64             `json:",omitempty"` // bytes written
+
+	// open only
+	Path    string `json:",omitempty"`
+	Flag    int    `json:",omitempty"`
+	Read    int64  `json:",omitempty"` // bytes read
+	Written int64  `json:",omitempty"` // bytes written
+
+	// Error is set if the module failed with an error other than
+	// ExitCode.
+	Error string `json:",omitempty"`
+
+	// Duration is how long the program ran for, or how long the file
+	// was open.
+	Duration time.Duration
+}
+
+// AuditLog writes an AuditEvent as a line of JSON for each program run
+// and file opened by the interpreter, for example to keep a record of
+// what scripts run by automation systems did.
+//
+// Each program's environment is logged as its difference from a base
+// environment, to keep the events short. The standard input of a
+// program is not counted, as that would stop it from being handed to
+// the program directly.
+type AuditLog struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	base map[string]string
+}
+
+// NewAuditLog returns an AuditLog writing to w. If base is nil, the
+// current process's environment is used as the base.
+func NewAuditLog(w io.Writer, base []string) *AuditLog {
+	if base == nil {
+		base = os.Environ()
+	}
+	return &AuditLog{enc: json.NewEncoder(w), base: envMap(base)}
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			m[kv[:i]] = kv[i+1:]
+		}
+	}
+	return m
+}
+
+func (a *AuditLog) log(ev *AuditEvent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.enc.Encode(ev)
+}
+
+// Exec wraps an exec module so that each program run is logged once it
+// finishes.
+func (a *AuditLog) Exec(next ModuleExec) ModuleExec {
+	return func(ctx Ctxt, name string, args []string) error {
+		ev := &AuditEvent{
+			Time: time.Now(),
+			Op:   "exec",
+			Dir:  ctx.Dir,
+			Args: append([]string{name}, args...),
+		}
+		env := envMap(ctx.Env)
+		for name, val := range env {
+			if old, ok := a.base[name]; !ok || old != val {
+				if ev.EnvSet == nil {
+					ev.EnvSet = make(map[string]string)
+				}
+				ev.EnvSet[name] = val
+			}
+		}
+		for name := range a.base {
+			if _, ok := env[name]; !ok {
+				ev.EnvUnset = append(ev.EnvUnset, name)
+			}
+		}
+		sort.Strings(ev.EnvUnset)
+		stdout := &countWriter{w: ctx.Stdout}
+		stderr := &countWriter{w: ctx.Stderr}
+		ctx.Stdout, ctx.Stderr = stdout, stderr
+		err := next(ctx, name, args)
+		ev.Duration = time.Since(ev.Time)
+		ev.Stdout, ev.Stderr = stdout.count(), stderr.count()
+		switch x := err.(type) {
+		case nil:
+		case ExitCode:
+			ev.Exit = int(x)
+		default:
+			ev.Error = err.Error()
+		}
+		if logErr := a.log(ev); logErr != nil {
+			return logErr
+		}
+		return err
+	}
+}
+
+// Open wraps an open module so that each file opened is logged once it
+// is closed, or right away if it could not be opened.
+func (a *AuditLog) Open(next ModuleOpen) ModuleOpen {
+	return func(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+		ev := &AuditEvent{
+			Time: time.Now(),
+			Op:   "open",
+			Dir:  ctx.Dir,
+			Path: path,
+			Flag: flag,
+		}
+		f, err := next(ctx, path, flag, perm)
+		if err != nil {
+			ev.Duration = time.Since(ev.Time)
+			ev.Error = err.Error()
+			if logErr := a.log(ev); logErr != nil {
+				return nil, logErr
+			}
+			return nil, err
+		}
+		return &auditFile{ReadWriteCloser: f, log: a, ev: ev}, nil
+	}
+}
+
+// countWriter counts the bytes written to it. It may be used
+// concurrently, as a program's output may be copied from another
+// goroutine.
+type countWriter struct {
+	w  io.Writer
+	mu sync.Mutex
+	n  int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.mu.Lock()
+	c.n += int64(n)
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *countWriter) count() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+type auditFile struct {
+	io.ReadWriteCloser
+	log *AuditLog
+
+	mu sync.Mutex
+	ev *AuditEvent
+}
+
+func (f *auditFile) Read(p []byte) (int, error) {
+	n, err := f.ReadWriteCloser.Read(p)
+	f.mu.Lock()
+	if f.ev != nil {
+		f.ev.Read += int64(n)
+	}
+	f.mu.Unlock()
+	return n, err
+}
+
+func (f *auditFile) Write(p []byte) (int, error) {
+	n, err := f.ReadWriteCloser.Write(p)
+	f.mu.Lock()
+	if f.ev != nil {
+		f.ev.Written += int64(n)
+	}
+	f.mu.Unlock()
+	return n, err
+}
+
+func (f *auditFile) Close() error {
+	err := f.ReadWriteCloser.Close()
+	f.mu.Lock()
+	ev := f.ev
+	f.ev = nil
+	f.mu.Unlock()
+	if ev == nil {
+		return err // already closed
+	}
+	ev.Duration = time.Since(ev.Time)
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	if logErr := f.log.log(ev); logErr != nil && err == nil {
+		err = logErr
+	}
+	return err
+}
@@ -4,8 +4,8 @@
 package interp
 
 import (
+	"bytes"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -20,7 +20,7 @@ func isBuiltin(name string) bool {
 		"wait", "builtin", "trap", "type", "source", ".", "command",
 		"dirs", "pushd", "popd", "umask", "alias", "unalias",
 		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return":
+		"return", "shopt", "read":
 		return true
 	}
 	return false
@@ -51,7 +51,11 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.errf("set: %v", err)
 			return 2
 		}
-		r.Params = rest
+		// only replace the parameters if any were given, or if
+		// the options were ended, as in "set --"
+		if n := len(args) - len(rest); len(rest) > 0 || (n > 0 && (args[n-1] == "--" || args[n-1] == "-")) {
+			r.Params = rest
+		}
 	case "shift":
 		n := 1
 		switch len(args) {
@@ -72,9 +76,16 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.Params = r.Params[n:]
 		}
 	case "unset":
+		code := 0
 		for _, arg := range args {
+			if r.vars[arg].readOnly {
+				r.errf("unset: %s: cannot unset: readonly variable\n", arg)
+				code = 1
+				continue
+			}
 			r.delVar(arg)
 		}
+		return code
 	case "echo":
 		newline, expand := true, false
 	echoOpts:
@@ -103,11 +114,86 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.outf("\n")
 		}
 	case "printf":
+		varName := ""
+		if len(args) > 1 && args[0] == "-v" {
+			varName, args = args[1], args[2:]
+			if !syntax.ValidName(varName) {
+				r.errf("printf: `%s': not a valid identifier\n", varName)
+				return 2
+			}
+		}
 		if len(args) == 0 {
 			r.errf("usage: printf format [arguments]\n")
 			return 2
 		}
-		r.outf("%s", r.expand(args[0], false, args[1:]...))
+		// the format is reused until all arguments are consumed
+		format, args := args[0], args[1:]
+		var buf bytes.Buffer
+		for {
+			s, rest := r.expandRest(format, false, args)
+			buf.WriteString(s)
+			if len(rest) == 0 || len(rest) == len(args) {
+				break
+			}
+			args = rest
+		}
+		if varName != "" {
+			r.setVar(varName, nil, buf.String())
+		} else {
+			r.outf("%s", buf.String())
+		}
+	case "read":
+		raw, delim := false, byte('\n')
+	readOpts:
+		for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+			switch args[0] {
+			case "--":
+				args = args[1:]
+				break readOpts
+			case "-r":
+				raw = true
+			case "-d":
+				if len(args) < 2 {
+					r.errf("read: -d: option requires an argument\n")
+					return 2
+				}
+				delim = 0 // -d '' reads until a null byte
+				if args[1] != "" {
+					delim = args[1][0]
+				}
+				args = args[1:]
+			default:
+				r.errf("read: %s: invalid option\n", args[0])
+				return 2
+			}
+			args = args[1:]
+		}
+		for _, name := range args {
+			if !syntax.ValidName(name) {
+				r.errf("read: `%s': not a valid identifier\n", name)
+				return 1
+			}
+		}
+		line, escaped, gotDelim := r.readLine(delim, raw)
+		if len(args) == 0 {
+			r.setVar("REPLY", nil, string(line))
+		} else {
+			ifs := " \t\n"
+			if val, ok := r.lookupVar("IFS"); ok {
+				ifs = r.varStr(val, 0)
+			}
+			fields := splitRead(line, escaped, ifs, len(args))
+			for i, name := range args {
+				val := ""
+				if i < len(fields) {
+					val = fields[i]
+				}
+				r.setVar(name, nil, val)
+			}
+		}
+		if !gotDelim {
+			return 1
+		}
 	case "break":
 		if !r.inLoop {
 			r.errf("break is only useful in a loop")
@@ -145,8 +231,39 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			return 2
 		}
 	case "pwd":
-		r.outf("%s\n", r.getVar("PWD"))
+		physical := false
+		for _, arg := range args {
+			switch arg {
+			case "-L":
+				physical = false
+			case "-P":
+				physical = true
+			default:
+				r.errf("usage: pwd [-L|-P]\n")
+				return 2
+			}
+		}
+		dir := r.getVar("PWD")
+		if physical {
+			if real, err := filepath.EvalSymlinks(r.Dir); err == nil {
+				dir = real
+			}
+		}
+		r.outf("%s\n", dir)
 	case "cd":
+		physical := false
+	cdOpts:
+		for len(args) > 0 {
+			switch args[0] {
+			case "-L":
+				physical = false
+			case "-P":
+				physical = true
+			default:
+				break cdOpts
+			}
+			args = args[1:]
+		}
 		var path string
 		switch len(args) {
 		case 0:
@@ -154,16 +271,44 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 		case 1:
 			path = args[0]
 		default:
-			r.errf("usage: cd [dir]\n")
+			r.errf("usage: cd [-L|-P] [dir]\n")
 			return 2
 		}
-		return r.changeDir(path)
+		printDir := false
+		switch {
+		case path == "-":
+			if path = r.getVar("OLDPWD"); path == "" {
+				r.errf("cd: OLDPWD not set\n")
+				return 1
+			}
+			printDir = true
+		case !filepath.IsAbs(path) && path != "." && path != ".." &&
+			!strings.HasPrefix(path, "./") && !strings.HasPrefix(path, "../"):
+			for _, dir := range filepath.SplitList(r.getVar("CDPATH")) {
+				if dir == "" {
+					// the current directory, which is
+					// tried last anyway
+					continue
+				}
+				cand := filepath.Join(dir, path)
+				if info, err := os.Stat(r.relPath(cand)); err == nil && info.IsDir() {
+					path, printDir = cand, true
+					break
+				}
+			}
+		}
+		if code := r.changeDir(path, physical); code != 0 {
+			return code
+		}
+		if printDir {
+			r.outf("%s\n", r.Dir)
+		}
 	case "wait":
 		if len(args) > 0 {
 			r.runErr(pos, "wait with args not handled yet")
 			break
 		}
-		r.bgShells.Wait()
+		r.Wait(r.Context)
 	case "builtin":
 		if len(args) < 1 {
 			break
@@ -183,7 +328,7 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 				r.outf("%s is a shell builtin\n", arg)
 				continue
 			}
-			if path, err := exec.LookPath(arg); err == nil {
+			if path, err := lookPath(r.environ(), r.Dir, arg); err == nil {
 				r.outf("%s is %s\n", arg, path)
 				continue
 			}
@@ -201,10 +346,12 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.errf("eval: %v\n", err)
 			return 1
 		}
-		r2 := *r
-		r2.Reset()
-		r2.Run(file)
-		return r2.exit
+		if !r.nest(pos) {
+			return 1
+		}
+		r.stmts(file.StmtList)
+		r.depth--
+		return r.exit
 	case "source", ".":
 		if len(args) < 1 {
 			r.runErr(pos, "source: need filename")
@@ -221,13 +368,21 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.errf("source: %v\n", err)
 			return 1
 		}
+		if !r.nest(pos) {
+			return 1
+		}
+		defer func() { r.depth-- }()
 		r2 := *r
 		r2.Params = args[1:]
 		r2.Reset()
+		r2.depth = r.depth
 		r2.canReturn = true
 		r2.Run(file)
-		if code, ok := r2.err.(returnCode); ok {
-			r2.exit = int(code)
+		switch x := r2.err.(type) {
+		case returnCode:
+			r2.exit = int(x)
+		case DepthError:
+			r.setErr(x)
 		}
 		return r2.exit
 	case "[":
@@ -286,7 +441,7 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			last = 0
 			if r.funcs[arg] != nil || isBuiltin(arg) {
 				r.outf("%s\n", arg)
-			} else if path, err := exec.LookPath(arg); err == nil {
+			} else if path, err := lookPath(r.environ(), r.Dir, arg); err == nil {
 				r.outf("%s\n", path)
 			} else {
 				last = 1
@@ -324,13 +479,13 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 				return 1
 			}
 			newtop := swap()
-			if code := r.changeDir(newtop); code != 0 {
+			if code := r.changeDir(newtop, false); code != 0 {
 				return code
 			}
 			r.builtinCode(syntax.Pos{}, "dirs", nil)
 		case 1:
 			if change {
-				if code := r.changeDir(args[0]); code != 0 {
+				if code := r.changeDir(args[0], false); code != 0 {
 					return code
 				}
 				r.dirStack = append(r.dirStack, r.Dir)
@@ -359,7 +514,7 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			r.dirStack = r.dirStack[:len(r.dirStack)-1]
 			if change {
 				newtop := r.dirStack[len(r.dirStack)-1]
-				if code := r.changeDir(newtop); code != 0 {
+				if code := r.changeDir(newtop, false); code != 0 {
 					return code
 				}
 			} else {
@@ -385,6 +540,54 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 			return 2
 		}
 		r.setErr(returnCode(code))
+	case "shopt":
+		mode, print, quiet := "", false, false
+		for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 's', 'u':
+					mode = string(c)
+				case 'p':
+					print = true
+				case 'q':
+					quiet = true
+				default:
+					r.errf("shopt: -%c: invalid option\n", c)
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		if len(args) == 0 {
+			// list all options, or only the set or unset ones
+			for _, name := range shoptNames {
+				if on := *r.shopt(name); mode == "" || on == (mode == "s") {
+					r.printShopt(name, on, print)
+				}
+			}
+			break
+		}
+		code := 0
+		for _, name := range args {
+			opt := r.shopt(name)
+			if opt == nil {
+				r.errf("shopt: %s: invalid shell option name\n", name)
+				code = 1
+				continue
+			}
+			switch mode {
+			case "s", "u":
+				*opt = mode == "s"
+			default:
+				if !quiet {
+					r.printShopt(name, *opt, print)
+				}
+				if !*opt {
+					code = 1
+				}
+			}
+		}
+		return code
 	default:
 		// "trap", "umask", "alias", "unalias", "fg", "bg",
 		// "getopts"
@@ -393,8 +596,25 @@ func (r *Runner) builtinCode(pos syntax.Pos, name string, args []string) int {
 	return 0
 }
 
-func (r *Runner) changeDir(path string) int {
-	path = r.relPath(path)
+// changeDir sets the current directory and updates PWD and OLDPWD. By
+// default, like in Bash, the directory is kept as a logical path, so
+// that ".." after following a symlink goes back to where we came from.
+// If physical is set, symlinks are resolved instead.
+func (r *Runner) changeDir(path string, physical bool) int {
+	if physical {
+		if !filepath.IsAbs(path) {
+			// not filepath.Join, as ".." must apply to the
+			// resolved path
+			path = r.Dir + string(filepath.Separator) + path
+		}
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return 1
+		}
+		path = real
+	} else {
+		path = r.relPath(path)
+	}
 	info, err := os.Stat(path)
 	if err != nil || !info.IsDir() {
 		return 1
@@ -402,14 +622,143 @@ func (r *Runner) changeDir(path string) int {
 	if !hasPermissionToDir(info) {
 		return 1
 	}
+	r.setVar("OLDPWD", nil, r.Dir)
 	r.Dir = path
-	r.vars["PWD"] = path
+	r.setVar("PWD", nil, path)
 	return 0
 }
 
+// sameFile reports whether two paths refer to the same existing file.
+func sameFile(path1, path2 string) bool {
+	info1, err1 := os.Stat(path1)
+	info2, err2 := os.Stat(path2)
+	return err1 == nil && err2 == nil && os.SameFile(info1, info2)
+}
+
 func (r *Runner) relPath(path string) string {
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(r.Dir, path)
 	}
 	return filepath.Clean(path)
 }
+
+// shoptNames holds the options supported by the shopt builtin.
+var shoptNames = []string{"nullglob"}
+
+// shopt returns a pointer to the value of a shopt option, or nil if the
+// option is not supported.
+func (r *Runner) shopt(name string) *bool {
+	switch name {
+	case "nullglob":
+		return &r.nullGlob
+	}
+	return nil
+}
+
+func (r *Runner) printShopt(name string, on, reusable bool) {
+	switch {
+	case reusable && on:
+		r.outf("shopt -s %s\n", name)
+	case reusable:
+		r.outf("shopt -u %s\n", name)
+	case on:
+		r.outf("%-15s\ton\n", name)
+	default:
+		r.outf("%-15s\toff\n", name)
+	}
+}
+
+// readLine reads from the standard input until delim or the end of the
+// input, whichever comes first, not including the delimiter. Input is
+// read one byte at a time, so that none is consumed past the delimiter.
+//
+// Unless raw is set, a backslash escapes the byte following it, and a
+// backslash-newline pair is removed. The escaped bytes are marked as
+// such, as they cannot separate fields.
+func (r *Runner) readLine(delim byte, raw bool) (line []byte, escaped []bool, gotDelim bool) {
+	if r.Stdin == nil {
+		return nil, nil, false
+	}
+	var b [1]byte
+	esc := false
+	for {
+		if n, err := r.Stdin.Read(b[:]); n == 0 {
+			if err != nil {
+				return line, escaped, false
+			}
+			continue
+		}
+		c := b[0]
+		switch {
+		case esc:
+			esc = false
+			if c == '\n' {
+				continue // line continuation
+			}
+			line = append(line, c)
+			escaped = append(escaped, true)
+			continue
+		case !raw && c == '\\':
+			esc = true
+			continue
+		case c == delim:
+			return line, escaped, true
+		}
+		line = append(line, c)
+		escaped = append(escaped, false)
+	}
+}
+
+// splitRead splits a line read by the read builtin into at most n
+// fields, following the rules of field splitting with the separators
+// in ifs. The last field holds the rest of the line.
+func splitRead(line []byte, escaped []bool, ifs string, n int) []string {
+	isSep := func(i int) bool {
+		return !escaped[i] && strings.IndexByte(ifs, line[i]) >= 0
+	}
+	isSpace := func(i int) bool {
+		return isSep(i) && strings.IndexByte(" \t\n", line[i]) >= 0
+	}
+	i := 0
+	for i < len(line) && isSpace(i) {
+		i++
+	}
+	end := len(line)
+	for end > i && isSpace(end-1) {
+		end--
+	}
+	// a separator is any amount of whitespace, with at most one
+	// other separator character in it
+	skipSep := func(i int) int {
+		for i < end && isSpace(i) {
+			i++
+		}
+		if i < end && isSep(i) && !isSpace(i) {
+			i++
+			for i < end && isSpace(i) {
+				i++
+			}
+		}
+		return i
+	}
+	fieldEnd := func(i int) int {
+		for i < end && !isSep(i) {
+			i++
+		}
+		return i
+	}
+	var fields []string
+	for len(fields) < n-1 && i < end {
+		j := fieldEnd(i)
+		fields = append(fields, string(line[i:j]))
+		i = skipSep(j)
+	}
+	if i < end {
+		// the rest loses its separator if it's a single field
+		if j := fieldEnd(i); skipSep(j) == end {
+			end = j
+		}
+		fields = append(fields, string(line[i:end]))
+	}
+	return fields
+}
@@ -0,0 +1,1130 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type coreUtil func(ctx Ctxt, args []string) error
+
+var coreUtils map[string]coreUtil
+
+func init() {
+	coreUtils = map[string]coreUtil{
+		"basename": utilBasename,
+		"cat":      utilCat,
+		"cp":       utilCp,
+		"dirname":  utilDirname,
+		"grep":     utilGrep,
+		"head":     utilHead,
+		"ls":       utilLs,
+		"mkdir":    utilMkdir,
+		"mv":       utilMv,
+		"realpath": utilRealpath,
+		"rm":       utilRm,
+		"sed":      utilSed,
+		"sleep":    utilSleep,
+		"tail":     utilTail,
+		"wc":       utilWc,
+	}
+}
+
+// CoreUtilsExec wraps an exec module, implementing a number of common
+// programs in pure Go: basename, cat, cp, dirname, grep, head, ls,
+// mkdir, mv, realpath, rm, sed, sleep, tail and wc. This allows running scripts
+// where no such binaries are available, or where os/exec cannot be
+// used at all.
+//
+// Only the most common options of each program are supported, and grep
+// and sed use the regular expression syntax of the regexp package,
+// after translating the basic syntax if needed. The sed program only
+// supports the s, d, p and q commands, with optional line number, $ or
+// regular expression addresses.
+//
+// Other programs are passed on to next. If next is nil, they are
+// reported as not found with an exit status of 127.
+func CoreUtilsExec(next ModuleExec) ModuleExec {
+	return func(ctx Ctxt, name string, args []string) error {
+		fn := coreUtils[name]
+		if fn == nil {
+			if next == nil {
+				fmt.Fprintf(ctx.Stderr, "%s: command not found\n", name)
+				return ExitCode(127)
+			}
+			return next(ctx, name, args)
+		}
+		return runUtil(ctx, name, fn, args)
+	}
+}
+
+// pathUtils are the programs implemented by PathUtilsExec.
+var pathUtils = map[string]bool{
+	"basename": true, "dirname": true, "realpath": true,
+}
+
+// PathUtilsExec wraps an exec module, implementing the basename,
+// dirname and realpath programs in pure Go like CoreUtilsExec does,
+// but only when they are not found in $PATH. This allows scripts that
+// use them to run in minimal environments lacking coreutils, while
+// still using the system's programs when they are available.
+//
+// All other programs are passed on to next.
+func PathUtilsExec(next ModuleExec) ModuleExec {
+	return func(ctx Ctxt, name string, args []string) error {
+		if pathUtils[name] {
+			if _, err := lookPath(ctx.Env, ctx.Dir, name); err != nil {
+				return runUtil(ctx, name, coreUtils[name], args)
+			}
+		}
+		return next(ctx, name, args)
+	}
+}
+
+func runUtil(ctx Ctxt, name string, fn coreUtil, args []string) error {
+	if ctx.Stdin == nil {
+		ctx.Stdin = strings.NewReader("")
+	}
+	switch err := fn(ctx, args); err.(type) {
+	case nil, ExitCode:
+		return err
+	default:
+		if err != io.ErrClosedPipe {
+			fmt.Fprintf(ctx.Stderr, "%s: %v\n", name, err)
+		}
+		return ExitCode(1)
+	}
+}
+
+// utilPath returns a path relative to the context's directory.
+func utilPath(ctx Ctxt, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(ctx.Dir, name)
+}
+
+// utilErr reports an error about a file, naming it as given by the
+// user instead of by its full path.
+func utilErr(ctx Ctxt, prog, name string, err error) {
+	switch x := err.(type) {
+	case *os.PathError:
+		err = x.Err
+	case *os.LinkError:
+		err = x.Err
+	}
+	fmt.Fprintf(ctx.Stderr, "%s: %s: %v\n", prog, name, err)
+}
+
+// utilFlags parses the leading single-letter flags in args, which may
+// be grouped like "-rf". Flags not in valid result in an error.
+func utilFlags(args []string, valid string) (map[byte]bool, []string, error) {
+	flags := make(map[byte]bool)
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+		for i := 1; i < len(arg); i++ {
+			if strings.IndexByte(valid, arg[i]) < 0 {
+				return nil, nil, fmt.Errorf("invalid option -- '%c'", arg[i])
+			}
+			flags[arg[i]] = true
+		}
+		args = args[1:]
+	}
+	return flags, args, nil
+}
+
+// eachInput calls fn with each of the named files, or with the
+// standard input if there are none or if a name is "-". Files that
+// can't be opened are reported and skipped, making the exit status 1.
+func eachInput(ctx Ctxt, prog string, files []string, fn func(name string, r io.Reader) error) error {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	failed := false
+	for _, name := range files {
+		if name == "-" {
+			if err := fn(name, ctx.Stdin); err != nil {
+				return err
+			}
+			continue
+		}
+		f, err := os.Open(utilPath(ctx, name))
+		if err != nil {
+			utilErr(ctx, prog, name, err)
+			failed = true
+			continue
+		}
+		err = fn(name, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+// eachLine calls fn with each of the lines read from r, including their
+// trailing newlines. The last line may not have one.
+func eachLine(r io.Reader, fn func(line string) (bool, error)) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if line != "" {
+			more, err := fn(line)
+			if err != nil || !more {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// lineCount parses the -n N and -N options of head and tail. A leading
+// plus sign is reported separately, as tail uses it to count from the
+// start.
+func lineCount(args []string) (n int, plus bool, rest []string, err error) {
+	n = 10
+	for len(args) > 0 {
+		arg, val := args[0], ""
+		switch {
+		case arg == "--":
+			return n, plus, args[1:], nil
+		case arg == "-n":
+			if len(args) < 2 {
+				return 0, false, nil, fmt.Errorf("option requires an argument -- 'n'")
+			}
+			val = args[1]
+			args = args[1:]
+		case strings.HasPrefix(arg, "-n"):
+			val = arg[2:]
+		case len(arg) > 1 && arg[0] == '-' && arg[1] >= '0' && arg[1] <= '9':
+			val = arg[1:]
+		case len(arg) > 1 && arg[0] == '-':
+			return 0, false, nil, fmt.Errorf("invalid option -- '%c'", arg[1])
+		default:
+			return n, plus, args, nil
+		}
+		args = args[1:]
+		plus = strings.HasPrefix(val, "+")
+		if n, err = strconv.Atoi(strings.TrimPrefix(val, "+")); err != nil || n < 0 {
+			return 0, false, nil, fmt.Errorf("invalid number of lines: %q", val)
+		}
+	}
+	return n, plus, args, nil
+}
+
+func utilBasename(ctx Ctxt, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return fmt.Errorf("usage: basename name [suffix]")
+	}
+	name := args[0]
+	if name != "" {
+		name = path.Base(name)
+	}
+	if len(args) == 2 && name != args[1] {
+		name = strings.TrimSuffix(name, args[1])
+	}
+	fmt.Fprintln(ctx.Stdout, name)
+	return nil
+}
+
+func utilDirname(ctx Ctxt, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing operand")
+	}
+	for _, name := range args {
+		// like basename, ignore trailing slashes
+		if trimmed := strings.TrimRight(name, "/"); trimmed != "" {
+			name = trimmed
+		}
+		fmt.Fprintln(ctx.Stdout, path.Dir(name))
+	}
+	return nil
+}
+
+func utilRealpath(ctx Ctxt, args []string) error {
+	flags, names, err := utilFlags(args, "ems")
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("missing operand")
+	}
+	failed := false
+	for _, name := range names {
+		full := filepath.Clean(utilPath(ctx, name))
+		if !flags['s'] {
+			full, err = realPath(full, flags)
+		} else if flags['e'] {
+			_, err = os.Stat(full)
+		}
+		if err != nil {
+			utilErr(ctx, "realpath", name, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintln(ctx.Stdout, full)
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+// realPath resolves the symbolic links in an absolute path. With the
+// -e flag all of its components must exist, and with -m none of them
+// need to. Otherwise, only the last one may be missing.
+func realPath(full string, flags map[byte]bool) (string, error) {
+	resolved, err := filepath.EvalSymlinks(full)
+	if err == nil || flags['e'] || !os.IsNotExist(err) {
+		return resolved, err
+	}
+	dir, base := filepath.Split(full)
+	dir = filepath.Clean(dir)
+	if dir == full {
+		return "", err
+	}
+	if flags['m'] {
+		dir, err = realPath(dir, flags)
+	} else {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, base), nil
+}
+
+func utilCat(ctx Ctxt, args []string) error {
+	_, files, err := utilFlags(args, "u")
+	if err != nil {
+		return err
+	}
+	return eachInput(ctx, "cat", files, func(_ string, r io.Reader) error {
+		_, err := io.Copy(ctx.Stdout, r)
+		return err
+	})
+}
+
+func utilLs(ctx Ctxt, args []string) error {
+	flags, names, err := utilFlags(args, "1ad")
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		names = []string{"."}
+	}
+	var files, dirs []string
+	failed := false
+	for _, name := range names {
+		info, err := os.Stat(utilPath(ctx, name))
+		if err != nil {
+			utilErr(ctx, "ls", name, err)
+			failed = true
+			continue
+		}
+		if info.IsDir() && !flags['d'] {
+			dirs = append(dirs, name)
+		} else {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	sort.Strings(dirs)
+	for _, name := range files {
+		fmt.Fprintln(ctx.Stdout, name)
+	}
+	for i, dir := range dirs {
+		f, err := os.Open(utilPath(ctx, dir))
+		if err != nil {
+			utilErr(ctx, "ls", dir, err)
+			failed = true
+			continue
+		}
+		entries, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			utilErr(ctx, "ls", dir, err)
+			failed = true
+			continue
+		}
+		if len(names) > 1 {
+			if i > 0 || len(files) > 0 {
+				fmt.Fprintln(ctx.Stdout)
+			}
+			fmt.Fprintf(ctx.Stdout, "%s:\n", dir)
+		}
+		if flags['a'] {
+			entries = append(entries, ".", "..")
+		}
+		sort.Strings(entries)
+		for _, entry := range entries {
+			if entry[0] != '.' || flags['a'] {
+				fmt.Fprintln(ctx.Stdout, entry)
+			}
+		}
+	}
+	if failed {
+		return ExitCode(2)
+	}
+	return nil
+}
+
+func utilMkdir(ctx Ctxt, args []string) error {
+	flags, names, err := utilFlags(args, "p")
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("missing operand")
+	}
+	failed := false
+	for _, name := range names {
+		if flags['p'] {
+			err = os.MkdirAll(utilPath(ctx, name), 0777)
+		} else {
+			err = os.Mkdir(utilPath(ctx, name), 0777)
+		}
+		if err != nil {
+			utilErr(ctx, "mkdir", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+func utilRm(ctx Ctxt, args []string) error {
+	flags, names, err := utilFlags(args, "rRf")
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 && !flags['f'] {
+		return fmt.Errorf("missing operand")
+	}
+	recursive := flags['r'] || flags['R']
+	failed := false
+	for _, name := range names {
+		full := utilPath(ctx, name)
+		info, err := os.Lstat(full)
+		switch {
+		case err != nil:
+			if flags['f'] && os.IsNotExist(err) {
+				continue
+			}
+		case info.IsDir() && !recursive:
+			err = fmt.Errorf("is a directory")
+		case recursive:
+			err = os.RemoveAll(full)
+		default:
+			err = os.Remove(full)
+		}
+		if err != nil {
+			utilErr(ctx, "rm", name, err)
+			failed = true
+		}
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+// utilTarget returns the destination for each source of cp and mv,
+// which is a path inside the last argument if it is a directory.
+func utilTarget(ctx Ctxt, args []string) (srcs []string, dst string, isDir bool, err error) {
+	if len(args) < 2 {
+		return nil, "", false, fmt.Errorf("missing file operand")
+	}
+	srcs, dst = args[:len(args)-1], args[len(args)-1]
+	info, err := os.Stat(utilPath(ctx, dst))
+	isDir = err == nil && info.IsDir()
+	if len(srcs) > 1 && !isDir {
+		return nil, "", false, fmt.Errorf("target %q is not a directory", dst)
+	}
+	return srcs, dst, isDir, nil
+}
+
+func utilCp(ctx Ctxt, args []string) error {
+	flags, args, err := utilFlags(args, "rR")
+	if err != nil {
+		return err
+	}
+	srcs, dst, isDir, err := utilTarget(ctx, args)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, src := range srcs {
+		to := dst
+		if isDir {
+			to = filepath.Join(dst, filepath.Base(src))
+		}
+		info, err := os.Stat(utilPath(ctx, src))
+		switch {
+		case err != nil:
+		case info.IsDir() && !flags['r'] && !flags['R']:
+			err = fmt.Errorf("-r not specified; omitting directory")
+		case info.IsDir():
+			err = copyTree(utilPath(ctx, src), utilPath(ctx, to))
+		default:
+			err = copyFile(utilPath(ctx, src), utilPath(ctx, to), info.Mode())
+		}
+		if err != nil {
+			utilErr(ctx, "cp", src, err)
+			failed = true
+		}
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(dst, rel)
+		if info.IsDir() {
+			if err := os.Mkdir(to, info.Mode().Perm()); err != nil && !os.IsExist(err) {
+				return err
+			}
+			return nil
+		}
+		return copyFile(path, to, info.Mode())
+	})
+}
+
+func utilMv(ctx Ctxt, args []string) error {
+	_, args, err := utilFlags(args, "f")
+	if err != nil {
+		return err
+	}
+	srcs, dst, isDir, err := utilTarget(ctx, args)
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, src := range srcs {
+		to := dst
+		if isDir {
+			to = filepath.Join(dst, filepath.Base(src))
+		}
+		if err := os.Rename(utilPath(ctx, src), utilPath(ctx, to)); err != nil {
+			utilErr(ctx, "mv", src, err)
+			failed = true
+		}
+	}
+	if failed {
+		return ExitCode(1)
+	}
+	return nil
+}
+
+// basicRegexp translates a POSIX basic regular expression into the
+// syntax of the regexp package, in which +, ?, |, braces and
+// parentheses are only special when escaped.
+func basicRegexp(expr string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == '\\' && i+1 < len(expr):
+			i++
+			if strings.IndexByte("+?|(){}", expr[i]) >= 0 {
+				buf.WriteByte(expr[i])
+			} else {
+				buf.WriteByte('\\')
+				buf.WriteByte(expr[i])
+			}
+		case strings.IndexByte("+?|(){}", c) >= 0:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+func utilGrep(ctx Ctxt, args []string) error {
+	flags, args, err := utilFlags(args, "EFcilnqsv")
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr, "grep: %v\n", err)
+		return ExitCode(2)
+	}
+	if len(args) == 0 {
+		fmt.Fprintln(ctx.Stderr, "usage: grep [-EFcilnqsv] pattern [file...]")
+		return ExitCode(2)
+	}
+	expr, files := args[0], args[1:]
+	switch {
+	case flags['F']:
+		expr = regexp.QuoteMeta(expr)
+	case !flags['E']:
+		expr = basicRegexp(expr)
+	}
+	if flags['i'] {
+		expr = "(?i)" + expr
+	}
+	rx, err := regexp.Compile(expr)
+	if err != nil {
+		fmt.Fprintf(ctx.Stderr, "grep: %v\n", err)
+		return ExitCode(2)
+	}
+	matched := false
+	err = eachInput(ctx, "grep", files, func(name string, r io.Reader) error {
+		if name == "-" {
+			name = "(standard input)"
+		}
+		count, lineNum := 0, 0
+		err := eachLine(r, func(line string) (bool, error) {
+			lineNum++
+			if rx.MatchString(strings.TrimSuffix(line, "\n")) == flags['v'] {
+				return true, nil
+			}
+			count++
+			matched = true
+			switch {
+			case flags['q']:
+				return false, nil
+			case flags['l']:
+				_, err := fmt.Fprintln(ctx.Stdout, name)
+				return false, err
+			case flags['c']:
+				return true, nil
+			}
+			if len(files) > 1 {
+				fmt.Fprintf(ctx.Stdout, "%s:", name)
+			}
+			if flags['n'] {
+				fmt.Fprintf(ctx.Stdout, "%d:", lineNum)
+			}
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			_, err := io.WriteString(ctx.Stdout, line)
+			return true, err
+		})
+		if err != nil {
+			return err
+		}
+		if flags['c'] && !flags['q'] {
+			if len(files) > 1 {
+				fmt.Fprintf(ctx.Stdout, "%s:", name)
+			}
+			fmt.Fprintln(ctx.Stdout, count)
+		}
+		return nil
+	})
+	switch {
+	case matched && flags['q']:
+		return nil
+	case err == ExitCode(1):
+		return ExitCode(2)
+	case err != nil:
+		return err
+	case !matched:
+		return ExitCode(1)
+	}
+	return nil
+}
+
+func utilHead(ctx Ctxt, args []string) error {
+	n, _, files, err := lineCount(args)
+	if err != nil {
+		return err
+	}
+	return eachInput(ctx, "head", files, func(name string, r io.Reader) error {
+		if len(files) > 1 {
+			if name != files[0] {
+				fmt.Fprintln(ctx.Stdout)
+			}
+			fmt.Fprintf(ctx.Stdout, "==> %s <==\n", name)
+		}
+		left := n
+		return eachLine(r, func(line string) (bool, error) {
+			if left == 0 {
+				return false, nil
+			}
+			left--
+			_, err := io.WriteString(ctx.Stdout, line)
+			return left > 0, err
+		})
+	})
+}
+
+func utilTail(ctx Ctxt, args []string) error {
+	n, fromStart, files, err := lineCount(args)
+	if err != nil {
+		return err
+	}
+	return eachInput(ctx, "tail", files, func(name string, r io.Reader) error {
+		if len(files) > 1 {
+			if name != files[0] {
+				fmt.Fprintln(ctx.Stdout)
+			}
+			fmt.Fprintf(ctx.Stdout, "==> %s <==\n", name)
+		}
+		var last []string
+		lineNum := 0
+		err := eachLine(r, func(line string) (bool, error) {
+			lineNum++
+			if fromStart {
+				if lineNum >= n {
+					_, err := io.WriteString(ctx.Stdout, line)
+					return true, err
+				}
+				return true, nil
+			}
+			if last = append(last, line); len(last) > n {
+				last = last[1:]
+			}
+			return true, nil
+		})
+		for _, line := range last {
+			if _, err := io.WriteString(ctx.Stdout, line); err != nil {
+				return err
+			}
+		}
+		return err
+	})
+}
+
+func utilWc(ctx Ctxt, args []string) error {
+	flags, files, err := utilFlags(args, "clw")
+	if err != nil {
+		return err
+	}
+	if len(flags) == 0 {
+		flags = map[byte]bool{'c': true, 'l': true, 'w': true}
+	}
+	type counts struct {
+		name                string
+		lines, words, bytes int
+	}
+	var all []counts
+	var total counts
+	err = eachInput(ctx, "wc", files, func(name string, r io.Reader) error {
+		c := counts{name: name}
+		br := bufio.NewReader(r)
+		inWord := false
+		for {
+			b, err := br.ReadByte()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			c.bytes++
+			switch b {
+			case '\n':
+				c.lines++
+				fallthrough
+			case ' ', '\t', '\r', '\v', '\f':
+				inWord = false
+			default:
+				if !inWord {
+					c.words++
+				}
+				inWord = true
+			}
+		}
+		all = append(all, c)
+		total.lines += c.lines
+		total.words += c.words
+		total.bytes += c.bytes
+		return nil
+	})
+	if len(files) > 1 {
+		total.name = "total"
+		all = append(all, total)
+	}
+	width := 7
+	switch {
+	case len(flags) == 1 && len(all) == 1:
+		width = 0
+	case len(files) > 0:
+		width = len(strconv.Itoa(total.bytes))
+	}
+	for _, c := range all {
+		var fields []string
+		for _, f := range []struct {
+			flag byte
+			n    int
+		}{{'l', c.lines}, {'w', c.words}, {'c', c.bytes}} {
+			if flags[f.flag] {
+				fields = append(fields, fmt.Sprintf("%*d", width, f.n))
+			}
+		}
+		if len(files) > 0 {
+			fields = append(fields, c.name)
+		}
+		fmt.Fprintln(ctx.Stdout, strings.Join(fields, " "))
+	}
+	return err
+}
+
+func utilSleep(ctx Ctxt, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing operand")
+	}
+	var total time.Duration
+	for _, arg := range args {
+		unit := time.Second
+		num := arg
+		if i := len(arg) - 1; i >= 0 {
+			switch arg[i] {
+			case 's':
+				num = arg[:i]
+			case 'm':
+				num, unit = arg[:i], time.Minute
+			case 'h':
+				num, unit = arg[:i], time.Hour
+			case 'd':
+				num, unit = arg[:i], 24*time.Hour
+			}
+		}
+		f, err := strconv.ParseFloat(num, 64)
+		if err != nil || f < 0 {
+			return fmt.Errorf("invalid time interval %q", arg)
+		}
+		total += time.Duration(f * float64(unit))
+	}
+	timer := time.NewTimer(total)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Context.Done():
+		return ctx.Context.Err()
+	}
+}
+
+// sedCmd is a single command in a sed script.
+type sedCmd struct {
+	line  int // address as a line number, or -1 for $
+	rx    *regexp.Regexp
+	op    byte
+	from  *regexp.Regexp // s command
+	to    string
+	flags string
+}
+
+func (c *sedCmd) matches(line string, lineNum int, last bool) bool {
+	switch {
+	case c.rx != nil:
+		return c.rx.MatchString(line)
+	case c.line > 0:
+		return c.line == lineNum
+	case c.line < 0:
+		return last
+	}
+	return true
+}
+
+// sedDelimited returns the text in s up to an unescaped delim, and
+// what follows the delimiter. Escaped delimiters are unescaped.
+func sedDelimited(s string, delim byte) (string, string, bool) {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == delim:
+			return buf.String(), s[i+1:], true
+		case c == '\\' && i+1 < len(s):
+			i++
+			if s[i] != delim {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(s[i])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	return "", "", false
+}
+
+func parseSed(script string, extended bool) ([]sedCmd, error) {
+	compile := func(expr string) (*regexp.Regexp, error) {
+		if !extended {
+			expr = basicRegexp(expr)
+		}
+		return regexp.Compile(expr)
+	}
+	var cmds []sedCmd
+	s := script
+	for {
+		s = strings.TrimLeft(s, " \t\n;")
+		if s == "" {
+			return cmds, nil
+		}
+		var c sedCmd
+		switch {
+		case s[0] == '$':
+			c.line = -1
+			s = s[1:]
+		case s[0] >= '0' && s[0] <= '9':
+			i := 0
+			for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+				i++
+			}
+			c.line, _ = strconv.Atoi(s[:i])
+			s = s[i:]
+		case s[0] == '/':
+			expr, rest, ok := sedDelimited(s[1:], '/')
+			if !ok {
+				return nil, fmt.Errorf("unterminated address regex")
+			}
+			var err error
+			if c.rx, err = compile(expr); err != nil {
+				return nil, err
+			}
+			s = rest
+		}
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return nil, fmt.Errorf("missing command")
+		}
+		c.op, s = s[0], s[1:]
+		switch c.op {
+		case 'd', 'p', 'q':
+		case 's':
+			if s == "" {
+				return nil, fmt.Errorf("unterminated `s' command")
+			}
+			delim := s[0]
+			from, rest, ok := sedDelimited(s[1:], delim)
+			if !ok {
+				return nil, fmt.Errorf("unterminated `s' command")
+			}
+			to, rest, ok := sedDelimited(rest, delim)
+			if !ok {
+				return nil, fmt.Errorf("unterminated `s' command")
+			}
+			i := 0
+			for i < len(rest) && strings.IndexByte("gpI", rest[i]) >= 0 {
+				i++
+			}
+			c.flags, s = rest[:i], rest[i:]
+			if strings.Contains(c.flags, "I") {
+				from = "(?i)" + from
+			}
+			var err error
+			if c.from, err = compile(from); err != nil {
+				return nil, err
+			}
+			c.to = to
+		default:
+			return nil, fmt.Errorf("unknown command: `%c'", c.op)
+		}
+		s = strings.TrimLeft(s, " \t")
+		if s != "" && s[0] != ';' && s[0] != '\n' {
+			return nil, fmt.Errorf("extra characters after command")
+		}
+		cmds = append(cmds, c)
+	}
+}
+
+// sedReplace expands a sed replacement for a match, where & stands for
+// the entire match and \1 to \9 for its groups.
+func sedReplace(buf *bytes.Buffer, src, to string, m []int) {
+	for i := 0; i < len(to); i++ {
+		c := to[i]
+		switch {
+		case c == '&':
+			buf.WriteString(src[m[0]:m[1]])
+		case c == '\\' && i+1 < len(to):
+			i++
+			c = to[i]
+			if n := int(c - '0'); c >= '0' && c <= '9' && 2*n+1 < len(m) {
+				if m[2*n] >= 0 {
+					buf.WriteString(src[m[2*n]:m[2*n+1]])
+				}
+				continue
+			}
+			if c == 'n' {
+				c = '\n'
+			}
+			buf.WriteByte(c)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+func (c *sedCmd) substitute(line string) (string, bool) {
+	all := strings.Contains(c.flags, "g")
+	var buf bytes.Buffer
+	last, done := 0, false
+	for _, m := range c.from.FindAllStringSubmatchIndex(line, -1) {
+		buf.WriteString(line[last:m[0]])
+		sedReplace(&buf, line, c.to, m)
+		last, done = m[1], true
+		if !all {
+			break
+		}
+	}
+	if !done {
+		return line, false
+	}
+	buf.WriteString(line[last:])
+	return buf.String(), true
+}
+
+func utilSed(ctx Ctxt, args []string) error {
+	var scripts []string
+	quiet, extended := false, false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		arg := args[0]
+		args = args[1:]
+		switch arg {
+		case "--":
+		case "-n":
+			quiet = true
+			continue
+		case "-E", "-r":
+			extended = true
+			continue
+		case "-e":
+			if len(args) == 0 {
+				return fmt.Errorf("option requires an argument -- 'e'")
+			}
+			scripts = append(scripts, args[0])
+			args = args[1:]
+			continue
+		default:
+			return fmt.Errorf("invalid option -- '%s'", arg[1:])
+		}
+		break
+	}
+	if len(scripts) == 0 {
+		if len(args) == 0 {
+			return fmt.Errorf("usage: sed [-nE] [-e script] script [file...]")
+		}
+		scripts, args = args[:1], args[1:]
+	}
+	cmds, err := parseSed(strings.Join(scripts, "\n"), extended)
+	if err != nil {
+		return fmt.Errorf("-e expression: %v", err)
+	}
+	// all the inputs make up a single stream, to know which is the
+	// last line we need to look ahead by one line
+	lineNum, quit := 0, false
+	var pending string
+	havePending := false
+	process := func(line string, last bool) error {
+		lineNum++
+		newline := strings.HasSuffix(line, "\n")
+		space := strings.TrimSuffix(line, "\n")
+		print := func() error {
+			_, err := io.WriteString(ctx.Stdout, space)
+			if err == nil && (newline || !last) {
+				_, err = io.WriteString(ctx.Stdout, "\n")
+			}
+			return err
+		}
+		for _, c := range cmds {
+			if !c.matches(space, lineNum, last) {
+				continue
+			}
+			switch c.op {
+			case 'd':
+				return nil
+			case 'p':
+				if err := print(); err != nil {
+					return err
+				}
+			case 'q':
+				quit = true
+				if quiet {
+					return nil
+				}
+				return print()
+			case 's':
+				var done bool
+				if space, done = c.substitute(space); done && strings.Contains(c.flags, "p") {
+					if err := print(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if quiet {
+			return nil
+		}
+		return print()
+	}
+	err = eachInput(ctx, "sed", args, func(_ string, r io.Reader) error {
+		return eachLine(r, func(line string) (bool, error) {
+			if quit {
+				return false, nil
+			}
+			if havePending {
+				if err := process(pending, false); err != nil || quit {
+					return false, err
+				}
+			}
+			pending, havePending = line, true
+			return true, nil
+		})
+	})
+	if havePending && !quit {
+		if perr := process(pending, true); perr != nil {
+			return perr
+		}
+	}
+	return err
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// Effect is a single side effect that a program may have.
+type Effect struct {
+	// Pos is the position of the command or redirection, if known.
+	Pos syntax.Pos
+
+	// Name is the program name, or the path of a file. If Dynamic
+	// is set, it is the shell source of a word whose value is only
+	// known at run time.
+	Name    string
+	Dynamic bool
+
+	// Args holds the arguments of a program, following the same
+	// rules as Name.
+	Args []string
+}
+
+// Effects lists the side effects that a program may have, so that
+// untrusted programs can be reviewed before running them.
+type Effects struct {
+	Commands []Effect // programs run, including via eval or source
+	Writes   []Effect // files written to
+	Reads    []Effect // files read from
+	Network  []Effect // programs and files that use the network
+
+	mu sync.Mutex
+}
+
+// networkPrograms are the programs reported as using the network.
+var networkPrograms = map[string]bool{
+	"curl": true, "wget": true, "ftp": true, "telnet": true,
+	"nc": true, "ncat": true, "netcat": true, "socat": true,
+	"ssh": true, "scp": true, "sftp": true, "rsync": true,
+}
+
+// wrapperBuiltins are the builtins that run another command given as
+// their arguments.
+var wrapperBuiltins = map[string]bool{
+	"command": true, "exec": true,
+}
+
+// AnalyzeEffects walks a program and reports its side effects without
+// running it: the programs it may run, the files its redirections may
+// read or write, and any network use.
+//
+// The analysis is static, so the names of programs and files that are
+// given via expansions cannot be known and are reported as Dynamic.
+// Calls to builtins and to functions declared in the program are not
+// reported, except for eval and source, whose arguments are reported as
+// commands since they run code that cannot be analyzed.
+//
+// For a more precise report, the program can instead be run with the
+// Effects' Exec and Open methods as modules, which record what the
+// program does without running any programs or opening any files.
+func AnalyzeEffects(f *syntax.File) *Effects {
+	funcs := make(map[string]bool)
+	syntax.Walk(f, func(node syntax.Node) bool {
+		if fd, ok := node.(*syntax.FuncDecl); ok {
+			funcs[fd.Name.Value] = true
+		}
+		return true
+	})
+	e := &Effects{}
+	syntax.Walk(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.CallExpr:
+			args := x.Args
+			for len(args) > 0 {
+				name, ok := staticWord(args[0])
+				if !ok || !wrapperBuiltins[name] {
+					break
+				}
+				args = args[1:]
+				// skip options like "command -p"
+				for len(args) > 0 {
+					opt, ok := staticWord(args[0])
+					if !ok || !strings.HasPrefix(opt, "-") {
+						break
+					}
+					if opt == "-v" || opt == "-V" {
+						return true // only looks up the command
+					}
+					args = args[1:]
+				}
+			}
+			if len(args) == 0 {
+				break
+			}
+			name, static := staticWord(args[0])
+			switch {
+			case !static:
+			case name == "eval", name == "source", name == ".":
+			case funcs[name], isBuiltin(name):
+				return true
+			}
+			eff := effectOf(args[0])
+			for _, arg := range args[1:] {
+				eff.Args = append(eff.Args, effectOf(arg).Name)
+			}
+			e.Commands = append(e.Commands, eff)
+			if static && networkPrograms[name] {
+				e.Network = append(e.Network, eff)
+			}
+		case *syntax.Redirect:
+			eff := effectOf(x.Word)
+			switch x.Op {
+			case syntax.RdrIn:
+				e.Reads = append(e.Reads, eff)
+			case syntax.RdrOut, syntax.AppOut, syntax.ClbOut, syntax.RdrAll, syntax.AppAll:
+				if eff.Name == "/dev/null" {
+					break
+				}
+				e.Writes = append(e.Writes, eff)
+			case syntax.RdrInOut:
+				e.Reads = append(e.Reads, eff)
+				e.Writes = append(e.Writes, eff)
+			default:
+				return true
+			}
+			if isNetworkPath(eff.Name) {
+				e.Network = append(e.Network, eff)
+			}
+		}
+		return true
+	})
+	return e
+}
+
+func isNetworkPath(path string) bool {
+	return strings.HasPrefix(path, "/dev/tcp/") || strings.HasPrefix(path, "/dev/udp/")
+}
+
+// staticWord returns the value of a word if it can be known without
+// running the program, such as with "foo" or 'foo', but not with $foo
+// or foo*.
+func staticWord(w *syntax.Word) (string, bool) {
+	var buf bytes.Buffer
+	for i, part := range w.Parts {
+		switch x := part.(type) {
+		case *syntax.Lit:
+			if hasGlob(x.Value) || (i == 0 && strings.HasPrefix(x.Value, "~")) {
+				return "", false
+			}
+			buf.WriteString(unescapePattern(x.Value))
+		case *syntax.SglQuoted:
+			if x.Dollar {
+				return "", false
+			}
+			buf.WriteString(x.Value)
+		case *syntax.DblQuoted:
+			for _, part := range x.Parts {
+				lit, ok := part.(*syntax.Lit)
+				if !ok {
+					return "", false
+				}
+				buf.WriteString(lit.Value)
+			}
+		default:
+			return "", false
+		}
+	}
+	return buf.String(), true
+}
+
+func effectOf(w *syntax.Word) Effect {
+	if s, ok := staticWord(w); ok {
+		return Effect{Pos: w.Pos(), Name: s}
+	}
+	var buf bytes.Buffer
+	f := &syntax.File{}
+	f.Stmts = []*syntax.Stmt{{
+		Position: w.Pos(),
+		Cmd:      &syntax.CallExpr{Args: []*syntax.Word{w}},
+	}}
+	syntax.NewPrinter().Print(&buf, f)
+	return Effect{Pos: w.Pos(), Name: strings.TrimSuffix(buf.String(), "\n"), Dynamic: true}
+}
+
+// Exec is an exec module that records the program in Commands, and in
+// Network if applicable, instead of running it. The program is treated
+// as having succeeded without any output.
+func (e *Effects) Exec(ctx Ctxt, name string, args []string) error {
+	eff := Effect{Name: name, Args: append([]string(nil), args...)}
+	e.mu.Lock()
+	e.Commands = append(e.Commands, eff)
+	if networkPrograms[name] {
+		e.Network = append(e.Network, eff)
+	}
+	e.mu.Unlock()
+	return nil
+}
+
+// Open is an open module that records the file in Reads or Writes, and
+// in Network if applicable, instead of opening it. Files read from are
+// empty, and anything written to them is discarded.
+func (e *Effects) Open(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	eff := Effect{Name: path}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	switch {
+	case flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		e.Reads = append(e.Reads, eff)
+	case path != "/dev/null":
+		e.Writes = append(e.Writes, eff)
+	}
+	if isNetworkPath(path) {
+		e.Network = append(e.Network, eff)
+	}
+	return devNull{}, nil
+}
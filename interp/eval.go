@@ -0,0 +1,96 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// Vars holds the variables used by EvalArithm and EvalTest.
+type Vars interface {
+	// Get returns the value of a variable, and whether it is set.
+	Get(name string) (string, bool)
+
+	// Set is called with the new value of each variable modified by
+	// an expression, such as via x++ or ${x:=3}.
+	Set(name, value string)
+}
+
+// evalExpr evaluates a standalone expression via eval, with a Runner
+// that cannot run programs nor open files unless setup says otherwise.
+// The variables from vars that the expression may use are fetched up
+// front, and the ones it modifies are stored back once it's done. Any
+// error printed by the Runner is returned as an error.
+func evalExpr(node syntax.Node, vars Vars, what string, setup, eval func(r *Runner)) error {
+	if err := noCommands(node, ""); err != nil {
+		return err
+	}
+	var stderr bytes.Buffer
+	r := &Runner{
+		Env:    []string{},
+		Stdout: &stderr,
+		Stderr: &stderr,
+		Exec: func(ctx Ctxt, name string, args []string) error {
+			return fmt.Errorf("cannot run %q in %s", name, what)
+		},
+		Open: func(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			return nil, fmt.Errorf("cannot open %q in %s", path, what)
+		},
+	}
+	if err := r.Reset(); err != nil {
+		return err
+	}
+	if setup != nil {
+		setup(r)
+	}
+	// fetch the variables that may be used up front, following
+	// values that are names themselves
+	var queue []string
+	syntax.Walk(node, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.ParamExp:
+			queue = append(queue, x.Param.Value)
+		case *syntax.Lit:
+			queue = append(queue, x.Value)
+		}
+		return true
+	})
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if seen[name] || !syntax.ValidName(name) {
+			continue
+		}
+		seen[name] = true
+		if val, ok := vars.Get(name); ok {
+			r.vars[name] = variable{value: val}
+			queue = append(queue, val)
+		}
+	}
+	before := make(map[string]variable, len(r.vars))
+	for name, vr := range r.vars {
+		before[name] = vr
+	}
+	eval(r)
+	if stderr.Len() > 0 {
+		return fmt.Errorf("%s", strings.TrimSpace(stderr.String()))
+	}
+	if r.err != nil {
+		return r.err
+	}
+	for name, vr := range r.vars {
+		val, ok := vr.value.(string)
+		if old, ok2 := before[name]; ok && (!ok2 || old.value != val) {
+			vars.Set(name, val)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"mvdan.cc/sh/interp"
+	"mvdan.cc/sh/syntax"
+)
+
+type memFile struct{ *bytes.Buffer }
+
+func (memFile) Close() error { return nil }
+
+// This example runs a script without touching the filesystem or
+// starting any processes, like a playground in the browser would when
+// built with GOOS=js. The files opened by the shell are kept in memory,
+// and programs other than the builtins are unavailable.
+func Example_sandbox() {
+	src := `
+echo foo >/greeting
+echo bar >>/greeting
+while read line; do echo "read $line"; done </greeting
+cat /greeting
+`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		return
+	}
+	files := make(map[string]*bytes.Buffer)
+	r := interp.Runner{
+		Dir:    "/",
+		Stdout: os.Stdout,
+		Stderr: os.Stdout,
+		Open: func(ctx interp.Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			buf, ok := files[path]
+			switch {
+			case flag&os.O_CREATE != 0 && (!ok || flag&os.O_TRUNC != 0):
+				buf = new(bytes.Buffer)
+				files[path] = buf
+			case !ok:
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+			}
+			if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+				// each reader gets its own copy
+				return memFile{bytes.NewBuffer(buf.Bytes())}, nil
+			}
+			return memFile{buf}, nil
+		},
+		Exec: func(ctx interp.Ctxt, name string, args []string) error {
+			fmt.Fprintf(ctx.Stderr, "%s: not available\n", name)
+			return interp.ExitCode(127)
+		},
+	}
+	r.Reset()
+	r.Run(file)
+	// Output:
+	// read foo
+	// read bar
+	// cat: not available
+}
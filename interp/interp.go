@@ -11,8 +11,8 @@ import (
 	"math"
 	"os"
 	"os/user"
-	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -31,10 +31,15 @@ import (
 type Runner struct {
 	// Env specifies the environment of the interpreter.
 	// If Env is nil, Run uses the current process's environment.
+	// Its variables are exported to the programs run by the
+	// interpreter, unless NoInheritEnv is set.
 	Env []string
 
-	// envMap is just Env as a map, to simplify and speed up its use
-	envMap map[string]string
+	// NoInheritEnv makes the programs run by the interpreter start
+	// with a clean environment, only containing the variables
+	// exported by the shell program itself. Env is still used to
+	// set the initial variables of the shell.
+	NoInheritEnv bool
 
 	// Dir specifies the working directory of the command. If Dir is
 	// the empty string, Run runs the command in the calling
@@ -51,14 +56,22 @@ type Runner struct {
 
 	filename string // only if Node was a File
 
+	// stmtIndex is the index of the top-level statement being run
+	// in the current File, and resumeAt is the one to start from in
+	// the next File run, as set by Restore.
+	stmtIndex, resumeAt int
+
 	// Separate maps, note that bash allows a name to be both a var
 	// and a func simultaneously
-	vars  map[string]varValue
+	vars  map[string]variable
 	funcs map[string]*syntax.Stmt
 
 	// like vars, but local to a cmd i.e. "foo=bar prog args..."
 	cmdVars map[string]varValue
 
+	// scopes holds a funcScope for each function call being run
+	scopes []funcScope
+
 	// >0 to break or continue out of N enclosing loops
 	breakEnclosing, contnEnclosing int
 
@@ -68,18 +81,64 @@ type Runner struct {
 	err  error // current fatal error
 	exit int   // current (last) exit code
 
+	// cmdErr is the CommandError of the last statement, if it ran
+	// a program that failed
+	cmdErr *CommandError
+
 	Stdin  io.Reader
 	Stdout io.Writer
 	Stderr io.Writer
 
-	bgShells sync.WaitGroup
+	// BackgroundStdin makes background jobs read from Stdin. By
+	// default, and like in Bash, they read from an empty input
+	// unless the program redirected their standard input, so that
+	// they don't compete for Stdin with the rest of the program.
+	BackgroundStdin bool
+
+	// WaitBackground makes Run wait for any background jobs to
+	// finish before returning. Otherwise, they may keep running
+	// after Run returns, and Wait should be used.
+	WaitBackground bool
+
+	bgJobs *bgJobs
+
+	// stdinRedirected is set once the program redirects the
+	// standard input, e.g. to a file or a pipe
+	stdinRedirected bool
 
 	// Context can be used to cancel the interpreter before it finishes
 	Context context.Context
 
+	// Metrics, if not nil, is told about each simple command that is
+	// run, be it a builtin, a function or a program.
+	Metrics Metrics
+
+	// MaxDepth limits how deeply function calls, eval, source and
+	// command substitutions may be nested, to stop programs that
+	// would otherwise recurse forever. Going over it stops the
+	// interpreter with a DepthError. If MaxDepth is zero,
+	// DefaultMaxDepth is used; if it is negative, there is no limit.
+	MaxDepth int
+
+	// depth is the current nesting depth, as limited by MaxDepth
+	depth int
+
 	stopOnCmdErr bool // set -e
+	nullGlob     bool // shopt -s nullglob
+
+	// noErrExit is set while running commands whose failure must not
+	// stop the program even with "set -e", such as negated ones or
+	// those in an if condition
+	noErrExit bool
+
+	// subshell is the subshell nesting depth, as in $BASH_SUBSHELL
+	subshell int
 
 	dirStack []string
+
+	// fs, if not nil, is used instead of the OS filesystem by file
+	// tests such as -f
+	fs StatFS
 }
 
 // Reset will set the unexported fields back to zero, fill any exported
@@ -92,44 +151,85 @@ type Runner struct {
 func (r *Runner) Reset() error {
 	// reset the internal state
 	*r = Runner{
-		Env:     r.Env,
-		Dir:     r.Dir,
-		Params:  r.Params,
-		Context: r.Context,
-		Stdin:   r.Stdin,
-		Stdout:  r.Stdout,
-		Stderr:  r.Stderr,
-		Exec:    r.Exec,
-		Open:    r.Open,
-	}
+		Env:          r.Env,
+		NoInheritEnv: r.NoInheritEnv,
+		Dir:          r.Dir,
+		Params:       r.Params,
+		Context:      r.Context,
+		Stdin:        r.Stdin,
+		Stdout:       r.Stdout,
+		Stderr:       r.Stderr,
+		Exec:         r.Exec,
+		Open:         r.Open,
+		Metrics:      r.Metrics,
+		MaxDepth:     r.MaxDepth,
+
+		BackgroundStdin: r.BackgroundStdin,
+		WaitBackground:  r.WaitBackground,
+	}
+	r.bgJobs = &bgJobs{}
 	if r.Context == nil {
 		r.Context = context.Background()
 	}
 	if r.Env == nil {
 		r.Env = os.Environ()
 	}
-	r.envMap = make(map[string]string, len(r.Env))
+	r.vars = make(map[string]variable, len(r.Env)+4)
 	for _, kv := range r.Env {
 		i := strings.IndexByte(kv, '=')
 		if i < 0 {
 			return fmt.Errorf("env not in the form key=value: %q", kv)
 		}
 		name, val := kv[:i], kv[i+1:]
-		r.envMap[name] = val
+		r.vars[name] = variable{exported: !r.NoInheritEnv, value: val}
+	}
+	// like in Bash, SHLVL counts how many shells are nested
+	shlvl, _ := strconv.Atoi(r.getVar("SHLVL"))
+	if shlvl++; shlvl < 0 {
+		shlvl = 0
+	}
+	r.vars["SHLVL"] = variable{
+		exported: !r.NoInheritEnv,
+		value:    strconv.Itoa(shlvl),
+	}
+	// like in Bash, inherited SHELLOPTS and BASHOPTS enable the
+	// options they list, and then reflect the current options
+	for _, opts := range []struct {
+		name string
+		opt  func(string) *bool
+	}{{"SHELLOPTS", r.setOpt}, {"BASHOPTS", r.shopt}} {
+		vr := r.vars[opts.name]
+		if s, ok := vr.value.(string); ok {
+			for _, name := range strings.Split(s, ":") {
+				if opt := opts.opt(name); opt != nil {
+					*opt = true
+				}
+			}
+		}
+		r.vars[opts.name] = variable{exported: vr.exported, readOnly: true, value: ""}
 	}
-	r.vars = make(map[string]varValue, 4)
-	if _, ok := r.envMap["HOME"]; !ok {
-		u, _ := user.Current()
-		r.vars["HOME"] = u.HomeDir
+	if _, ok := r.vars["HOME"]; !ok {
+		home := ""
+		// the current user may be unknown, such as on js/wasm
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+		r.vars["HOME"] = variable{value: home}
 	}
 	if r.Dir == "" {
 		dir, err := os.Getwd()
 		if err != nil {
 			return fmt.Errorf("could not get current dir: %v", err)
 		}
+		// like in Bash, keep PWD if it's a logical path to the
+		// current directory, such as via a symlink
+		if pwd := r.getVar("PWD"); pwd != dir && filepath.IsAbs(pwd) &&
+			filepath.Clean(pwd) == pwd && sameFile(pwd, dir) {
+			dir = pwd
+		}
 		r.Dir = dir
 	}
-	r.vars["PWD"] = r.Dir
+	r.setVar("PWD", nil, r.Dir)
 	r.dirStack = []string{r.Dir}
 	if r.Exec == nil {
 		r.Exec = DefaultExec
@@ -141,18 +241,86 @@ func (r *Runner) Reset() error {
 }
 
 func (r *Runner) ctx() Ctxt {
-	c := Ctxt{
+	return Ctxt{
 		Context: r.Context,
-		Env:     r.Env,
+		Env:     r.environ(),
 		Dir:     r.Dir,
 		Stdin:   r.Stdin,
 		Stdout:  r.Stdout,
 		Stderr:  r.Stderr,
 	}
+}
+
+// environ returns the environment for a program to be run, made up of
+// the exported variables and the ones local to the current command.
+// Arrays cannot be exported, so they are left out.
+func (r *Runner) environ() []string {
+	// never nil, as that means the current process's env to os/exec
+	env := make([]string, 0, len(r.vars))
+	add := func(name string, val varValue) {
+		switch val.(type) {
+		case string, nameRef:
+			env = append(env, name+"="+r.varStr(val, 0))
+		}
+	}
+	for name, vr := range r.vars {
+		if _, ok := r.cmdVars[name]; ok || !vr.exported {
+			continue
+		}
+		// not vr.value, to export the value of variables like
+		// SHELLOPTS
+		val, _ := r.lookupVar(name)
+		add(name, val)
+	}
 	for name, val := range r.cmdVars {
-		c.Env = append(c.Env, name+"="+r.varStr(val, 0))
+		add(name, val)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// variable is a shell variable along with its attributes. A nil value
+// means that the variable is declared, but unset.
+type variable struct {
+	exported bool
+	readOnly bool
+	value    varValue
+}
+
+// funcScope records the variables made local to a function call, along
+// with the variables that they shadow, which are restored once the
+// call returns. A nil variable means that the name was not set.
+type funcScope map[string]*variable
+
+func (r *Runner) pushScope() {
+	r.scopes = append(r.scopes, funcScope{})
+}
+
+func (r *Runner) popScope() {
+	top := r.scopes[len(r.scopes)-1]
+	for name, prev := range top {
+		if prev == nil {
+			delete(r.vars, name)
+		} else {
+			r.vars[name] = *prev
+		}
 	}
-	return c
+	r.scopes = r.scopes[:len(r.scopes)-1]
+}
+
+// declareLocal makes a variable local to the current function call,
+// declared but unset. Any previous variable is shadowed until the call
+// returns.
+func (r *Runner) declareLocal(name string) {
+	top := r.scopes[len(r.scopes)-1]
+	if _, ok := top[name]; !ok {
+		if prev, ok := r.vars[name]; ok {
+			top[name] = &prev
+		} else {
+			top[name] = nil
+		}
+	}
+	r.vars[name] = variable{}
 }
 
 // varValue can hold any of:
@@ -256,6 +424,45 @@ func (e RunError) Error() string {
 	return fmt.Sprintf("%s:%s: %s", e.Filename, e.Pos.String(), e.Text)
 }
 
+// DefaultMaxDepth is the maximum nesting depth used when
+// Runner.MaxDepth is zero.
+const DefaultMaxDepth = 1000
+
+// DepthError is returned when function calls, eval, source or command
+// substitutions are nested deeper than Runner.MaxDepth, such as with a
+// function that calls itself endlessly.
+type DepthError struct {
+	Filename string
+	syntax.Pos
+	Max int
+}
+
+func (e DepthError) Error() string {
+	err := RunError{
+		Filename: e.Filename,
+		Pos:      e.Pos,
+		Text:     fmt.Sprintf("maximum nesting depth of %d exceeded", e.Max),
+	}
+	return err.Error()
+}
+
+// nest increases the nesting depth before running a function call,
+// eval, source or command substitution, which must then decrease it.
+// If the maximum depth would be exceeded, it stops the interpreter and
+// returns false instead.
+func (r *Runner) nest(pos syntax.Pos) bool {
+	max := r.MaxDepth
+	if max == 0 {
+		max = DefaultMaxDepth
+	}
+	if max > 0 && r.depth >= max {
+		r.setErr(DepthError{Filename: r.filename, Pos: pos, Max: max})
+		return false
+	}
+	r.depth++
+	return true
+}
+
 func (r *Runner) setErr(err error) {
 	if r.err == nil {
 		r.err = err
@@ -276,62 +483,135 @@ func (r *Runner) lastExit() {
 	}
 }
 
-func (r *Runner) setVar(name string, index syntax.ArithmExpr, val varValue) {
+func (r *Runner) setVar(name string, index *varIndex, val varValue) {
+	vr := r.vars[name]
+	if vr.readOnly {
+		r.errf("%s: readonly variable\n", name)
+		r.exit = 1
+		r.lastExit()
+		return
+	}
+	defer func() { r.vars[name] = vr }()
 	if index == nil {
-		r.vars[name] = val
+		vr.value = val
 		return
 	}
 	// from the syntax package, we know that val must be a string if
 	// index is non-nil; nested arrays are forbidden.
 	valStr := val.(string)
-	// if the existing variable is already an arrayMap, try our best
-	// to convert the key to a string
-	_, isArrayMap := r.vars[name].(arrayMap)
-	if stringIndex(index) || isArrayMap {
+	if index.assoc {
 		var amap arrayMap
-		switch x := r.vars[name].(type) {
+		switch x := vr.value.(type) {
 		case string, []string:
 			return // TODO
 		case arrayMap:
 			amap = x
 		}
-		w, ok := index.(*syntax.Word)
-		if !ok {
-			return
-		}
-		k := r.loneWord(w)
-		if _, ok := amap.vals[k]; !ok {
-			amap.keys = append(amap.keys, k)
+		if _, ok := amap.vals[index.key]; !ok {
+			amap.keys = append(amap.keys, index.key)
 		}
-		amap.vals[k] = valStr
-		r.vars[name] = amap
+		amap.vals[index.key] = valStr
+		vr.value = amap
 		return
 	}
 	var list []string
-	switch x := r.vars[name].(type) {
+	switch x := vr.value.(type) {
 	case string:
 		list = []string{x}
 	case []string:
 		list = x
-	case arrayMap: // done above
 	}
-	k := r.arithm(index)
+	k := index.n
+	if k < 0 {
+		k += len(list)
+	}
+	if k < 0 {
+		r.errf("%s[%d]: bad array subscript\n", name, index.n)
+		r.exit = 1
+		return
+	}
 	for len(list) < k+1 {
 		list = append(list, "")
 	}
 	list[k] = valStr
-	r.vars[name] = list
+	vr.value = list
+}
+
+// varIndex is an array index that has already been evaluated, so that
+// any side effects in its expression only happen once.
+type varIndex struct {
+	assoc bool
+	key   string // if assoc
+	n     int    // if not assoc
+}
+
+// evalIndex evaluates an index to be used with a variable. Indexes are
+// expanded as words for associative arrays, and evaluated as
+// arithmetic expressions otherwise.
+func (r *Runner) evalIndex(name string, expr syntax.ArithmExpr) *varIndex {
+	if expr == nil {
+		return nil
+	}
+	// if the existing variable is already an arrayMap, try our best
+	// to convert the key to a string
+	_, isArrayMap := r.vars[name].value.(arrayMap)
+	if stringIndex(expr) || isArrayMap {
+		index := &varIndex{assoc: true}
+		if w, ok := expr.(*syntax.Word); ok {
+			index.key = r.loneWord(w)
+		}
+		return index
+	}
+	return &varIndex{n: r.arithm(expr)}
+}
+
+// indexValue returns the element at an index, as previously evaluated
+// with evalIndex.
+func indexValue(val varValue, index *varIndex) string {
+	switch x := val.(type) {
+	case string:
+		if !index.assoc && index.n == 0 {
+			return x
+		}
+	case []string:
+		k := index.n
+		if k < 0 {
+			k += len(x)
+		}
+		if !index.assoc && k >= 0 && k < len(x) {
+			return x[k]
+		}
+	case arrayMap:
+		return x.vals[index.key]
+	}
+	return ""
 }
 
 func (r *Runner) lookupVar(name string) (varValue, bool) {
 	if val, e := r.cmdVars[name]; e {
 		return val, true
 	}
-	if val, e := r.vars[name]; e {
+	if val, ok := r.dynamicVar(name); ok {
 		return val, true
 	}
-	str, e := r.envMap[name]
-	return str, e
+	if vr, e := r.vars[name]; e && vr.value != nil {
+		return vr.value, true
+	}
+	return nil, false
+}
+
+// dynamicVar returns the value of a special variable that reflects the
+// state of the interpreter, such as $BASH_SUBSHELL.
+func (r *Runner) dynamicVar(name string) (varValue, bool) {
+	switch name {
+	case "BASH_SUBSHELL":
+		return strconv.Itoa(r.subshell), true
+	case "SHELLOPTS":
+		return r.optsVar(setOptNames, r.setOpt), true
+	case "BASHOPTS":
+		return r.optsVar(shoptNames, r.shopt), true
+	}
+	return nil, false
 }
 
 func (r *Runner) getVar(name string) string {
@@ -339,9 +619,31 @@ func (r *Runner) getVar(name string) string {
 	return r.varStr(val, 0)
 }
 
+// delVar unsets a variable following bash's dynamic scoping. A
+// variable local to the current function call remains declared but
+// unset, while unsetting one local to a calling function exposes the
+// variable that it shadowed.
 func (r *Runner) delVar(name string) {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		prev, ok := r.scopes[i][name]
+		if !ok {
+			continue
+		}
+		if i == len(r.scopes)-1 {
+			vr := r.vars[name]
+			vr.value = nil
+			r.vars[name] = vr
+			return
+		}
+		delete(r.scopes[i], name)
+		if prev == nil {
+			delete(r.vars, name)
+		} else {
+			r.vars[name] = *prev
+		}
+		return
+	}
 	delete(r.vars, name)
-	delete(r.envMap, name)
 }
 
 func (r *Runner) setFunc(name string, body *syntax.Stmt) {
@@ -368,6 +670,12 @@ opts:
 		case "-":
 			args = args[1:]
 			break opts
+		case "":
+			if enable { // "-", as "--"
+				args = args[1:]
+				break opts
+			}
+			return nil, fmt.Errorf("invalid option: %q", opt)
 		case "e":
 			r.stopOnCmdErr = enable
 		default:
@@ -378,13 +686,56 @@ opts:
 	return args, nil
 }
 
+// setOptNames holds the options supported by the set builtin, by their
+// long names.
+var setOptNames = []string{"errexit"}
+
+// setOpt returns a pointer to the value of a set option, or nil if the
+// option is not supported.
+func (r *Runner) setOpt(name string) *bool {
+	switch name {
+	case "errexit":
+		return &r.stopOnCmdErr
+	}
+	return nil
+}
+
+// optsVar returns the enabled options out of names separated by colons,
+// as in $SHELLOPTS.
+func (r *Runner) optsVar(names []string, opt func(string) *bool) string {
+	var on []string
+	for _, name := range names {
+		if *opt(name) {
+			on = append(on, name)
+		}
+	}
+	return strings.Join(on, ":")
+}
+
+// optFlags returns the shell options currently set, in the form
+// accepted by FromArgs.
+func (r *Runner) optFlags() []string {
+	var flags []string
+	if r.stopOnCmdErr {
+		flags = append(flags, "-e")
+	}
+	return flags
+}
+
 // Run starts the interpreter and returns any error.
 func (r *Runner) Run(node syntax.Node) error {
 	r.filename = ""
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
-		r.stmts(x.StmtList)
+		start := r.resumeAt
+		r.resumeAt = 0
+		for r.stmtIndex = start; r.stmtIndex < len(x.Stmts); r.stmtIndex++ {
+			if r.stop() {
+				break
+			}
+			r.stmt(x.Stmts[r.stmtIndex])
+		}
 	case *syntax.Stmt:
 		r.stmt(x)
 	case syntax.Command:
@@ -392,13 +743,53 @@ func (r *Runner) Run(node syntax.Node) error {
 	default:
 		return fmt.Errorf("Node can only be File, Stmt, or Command: %T", x)
 	}
+	return r.finish()
+}
+
+// RunReader parses and runs a program read from rd, one statement at a
+// time. Unlike parsing the whole program and calling Run, each
+// statement is run as soon as it has been parsed, and no more input is
+// read once the program stops, such as via the exit builtin. The name
+// is used in parse errors.
+//
+// If ctx is not nil, it replaces the Runner's Context.
+func (r *Runner) RunReader(ctx context.Context, rd io.Reader, name string) error {
+	if ctx != nil {
+		r.Context = ctx
+	}
+	r.filename = name
+	err := syntax.NewParser().Stmts(rd, func(s *syntax.Stmt) bool {
+		r.stmt(s)
+		return !r.stop()
+	})
+	if perr, ok := err.(*syntax.ParseError); ok {
+		perr.Filename = name
+	}
+	if err != nil && r.err == nil {
+		return err
+	}
+	return r.finish()
+}
+
+// finish is called once a program has stopped running, returning the
+// error to report from Run.
+func (r *Runner) finish() error {
+	if r.WaitBackground {
+		r.setErr(r.Wait(r.Context))
+	}
 	r.lastExit()
+	if code, ok := r.err.(ExitCode); ok && r.cmdErr != nil && code == r.cmdErr.Exit {
+		r.err = r.cmdErr
+	}
 	if r.err == ExitCode(0) {
 		r.err = nil
 	}
 	return r.err
 }
 
+// Stmt runs a single statement, keeping the Runner's state for the
+// next call. Along with syntax.Parser.Stmts, it allows running a
+// program as it is parsed.
 func (r *Runner) Stmt(stmt *syntax.Stmt) error {
 	r.stmt(stmt)
 	return r.err
@@ -413,28 +804,48 @@ func (r *Runner) errf(format string, a ...interface{}) {
 }
 
 func (r *Runner) expand(format string, onlyChars bool, args ...string) string {
+	s, _ := r.expandRest(format, onlyChars, args)
+	return s
+}
+
+// expandRest is like expand, but also returns the arguments that were
+// not used by the format.
+func (r *Runner) expandRest(format string, onlyChars bool, args []string) (string, []string) {
 	var buf bytes.Buffer
 	esc, fmt := false, false
-	for _, c := range format {
+	for i := 0; i < len(format); i++ {
+		c := format[i]
 		if esc {
 			esc = false
 			switch c {
 			case 'n':
-				buf.WriteRune('\n')
+				buf.WriteByte('\n')
 			case 'r':
-				buf.WriteRune('\r')
+				buf.WriteByte('\r')
 			case 't':
-				buf.WriteRune('\t')
+				buf.WriteByte('\t')
 			case '\\':
-				buf.WriteRune('\\')
+				buf.WriteByte('\\')
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				// octal value of up to three digits
+				n, j := 0, i
+				for ; j < len(format) && j < i+3 && '0' <= format[j] && format[j] <= '7'; j++ {
+					n = n*8 + int(format[j]-'0')
+				}
+				buf.WriteByte(byte(n))
+				i = j - 1
 			default:
-				buf.WriteRune('\\')
-				buf.WriteRune(c)
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
 			}
 			continue
 		}
 		if fmt {
 			fmt = false
+			if c == '%' {
+				buf.WriteByte('%')
+				continue
+			}
 			arg := ""
 			n := 0
 			if len(args) > 0 {
@@ -469,10 +880,10 @@ func (r *Runner) expand(format string, onlyChars bool, args ...string) string {
 		} else if !onlyChars && c == '%' {
 			fmt = true
 		} else {
-			buf.WriteRune(c)
+			buf.WriteByte(c)
 		}
 	}
-	return buf.String()
+	return buf.String(), args
 }
 
 func fieldJoin(parts []fieldPart) string {
@@ -503,28 +914,20 @@ func escapedGlob(parts []fieldPart) (escaped string, glob bool) {
 
 func (r *Runner) Fields(words []*syntax.Word) []string {
 	fields := make([]string, 0, len(words))
-	baseDir, _ := escapedGlob([]fieldPart{{val: r.Dir}})
 	for _, word := range words {
 		for _, field := range r.wordFields(word.Parts, false) {
 			path, glob := escapedGlob(field)
 			var matches []string
-			abs := filepath.IsAbs(path)
 			if glob {
-				if !abs {
-					path = filepath.Join(baseDir, path)
-				}
-				matches, _ = filepath.Glob(path)
+				matches = r.glob(path)
 			}
 			if len(matches) == 0 {
-				fields = append(fields, fieldJoin(field))
-				continue
-			}
-			for _, match := range matches {
-				if !abs {
-					match, _ = filepath.Rel(baseDir, match)
+				if !glob || !r.nullGlob {
+					fields = append(fields, fieldJoin(field))
 				}
-				fields = append(fields, match)
+				continue
 			}
+			fields = append(fields, matches...)
 		}
 	}
 	return fields
@@ -535,7 +938,7 @@ func (r *Runner) loneWord(word *syntax.Word) string {
 		return ""
 	}
 	var buf bytes.Buffer
-	for _, field := range r.wordFields(word.Parts, false) {
+	for _, field := range r.wordFields(word.Parts, true) {
 		for _, part := range field {
 			buf.WriteString(part.val)
 		}
@@ -543,6 +946,23 @@ func (r *Runner) loneWord(word *syntax.Word) string {
 	return buf.String()
 }
 
+// pattern expands a word to be used as a pattern, such as in case
+// clauses or ${var#pattern}. Like in Bash, the characters coming from
+// quoted parts are matched literally, while those from unquoted parts,
+// including parameter expansions, may act as wildcards. No field
+// splitting is done.
+func (r *Runner) pattern(word *syntax.Word) string {
+	if word == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	for _, field := range r.wordFields(word.Parts, true) {
+		escaped, _ := escapedGlob(field)
+		buf.WriteString(escaped)
+	}
+	return buf.String()
+}
+
 func (r *Runner) stop() bool {
 	if r.err != nil {
 		return true
@@ -559,11 +979,15 @@ func (r *Runner) stmt(st *syntax.Stmt) {
 		return
 	}
 	if st.Background {
-		r.bgShells.Add(1)
 		r2 := r.sub()
+		if !r.BackgroundStdin && !r.stdinRedirected {
+			r2.Stdin = nil
+		}
+		var done func()
+		r2.Context, done = r.bgJobs.start(r.Context)
 		go func() {
 			r2.stmtSync(st)
-			r.bgShells.Done()
+			done()
 		}()
 	} else {
 		r.stmtSync(st)
@@ -579,29 +1003,40 @@ func stringIndex(index syntax.ArithmExpr) bool {
 	return ok
 }
 
-func (r *Runner) assignValue(as *syntax.Assign, mode string) varValue {
+// assignValue returns the value of an assignment along with the index
+// that it is assigned to, if any. Like in Bash, the index is evaluated
+// once and after the value.
+func (r *Runner) assignValue(as *syntax.Assign, mode string) (*varIndex, varValue) {
 	prev, _ := r.lookupVar(as.Name.Value)
 	if as.Value != nil {
 		s := r.loneWord(as.Value)
+		index := r.evalIndex(as.Name.Value, as.Index)
 		if !as.Append || prev == nil {
-			return s
+			return index, s
+		}
+		if index != nil {
+			return index, indexValue(prev, index) + s
 		}
 		switch x := prev.(type) {
 		case string:
-			return x + s
+			return nil, x + s
 		case []string:
 			if len(x) == 0 {
-				return []string{s}
+				return nil, []string{s}
 			}
 			x[0] += s
-			return x
+			return nil, x
 		case arrayMap:
 			// TODO
 		}
-		return s
+		return nil, s
 	}
+	return nil, r.arrayValue(as, prev, mode)
+}
+
+func (r *Runner) arrayValue(as *syntax.Assign, prev varValue, mode string) varValue {
 	if as.Array == nil {
-		return nil
+		return ""
 	}
 	elems := as.Array.Elems
 	if mode == "" {
@@ -631,16 +1066,18 @@ func (r *Runner) assignValue(as *syntax.Assign, mode string) varValue {
 		// TODO
 		return amap
 	}
-	// indexed array
+	// indexed array; each index is evaluated once, and elements
+	// without one follow the previous element
 	maxIndex := len(elems) - 1
 	indexes := make([]int, len(elems))
+	next := 0
 	for i, elem := range elems {
-		if elem.Index == nil {
-			indexes[i] = i
-			continue
+		k := next
+		if elem.Index != nil {
+			k = r.arithm(elem.Index)
 		}
-		k := r.arithm(elem.Index)
 		indexes[i] = k
+		next = k + 1
 		if k > maxIndex {
 			maxIndex = k
 		}
@@ -665,6 +1102,8 @@ func (r *Runner) assignValue(as *syntax.Assign, mode string) varValue {
 
 func (r *Runner) stmtSync(st *syntax.Stmt) {
 	oldIn, oldOut, oldErr := r.Stdin, r.Stdout, r.Stderr
+	oldRedirected := r.stdinRedirected
+	r.cmdErr = nil
 	for _, rd := range st.Redirs {
 		cls, err := r.redir(rd)
 		if err != nil {
@@ -677,6 +1116,8 @@ func (r *Runner) stmtSync(st *syntax.Stmt) {
 	}
 	if st.Cmd == nil {
 		r.exit = 0
+	} else if st.Negated {
+		r.cmdNoErrExit(st.Cmd)
 	} else {
 		r.cmd(st.Cmd)
 	}
@@ -684,6 +1125,7 @@ func (r *Runner) stmtSync(st *syntax.Stmt) {
 		r.exit = oneIf(r.exit == 0)
 	}
 	r.Stdin, r.Stdout, r.Stderr = oldIn, oldOut, oldErr
+	r.stdinRedirected = oldRedirected
 }
 
 func oneIf(b bool) int {
@@ -695,16 +1137,93 @@ func oneIf(b bool) int {
 
 func (r *Runner) sub() *Runner {
 	r2 := *r
-	r2.bgShells = sync.WaitGroup{}
+	r2.bgJobs = &bgJobs{}
+	r2.subshell++
 	// TODO: perhaps we could do a lazy copy here, or some sort of
 	// overlay to avoid copying all the time
-	r2.vars = make(map[string]varValue, len(r.vars))
+	r2.vars = make(map[string]variable, len(r.vars))
 	for k, v := range r.vars {
 		r2.vars[k] = v
 	}
+	r2.scopes = make([]funcScope, len(r.scopes))
+	for i, scope := range r.scopes {
+		r2.scopes[i] = make(funcScope, len(scope))
+		for k, v := range scope {
+			r2.scopes[i][k] = v
+		}
+	}
 	return &r2
 }
 
+// Wait blocks until all background jobs started by the Runner have
+// finished. If ctx is done before then, the jobs are killed and
+// ctx.Err() is returned once they have stopped.
+func (r *Runner) Wait(ctx context.Context) error {
+	if r.bgJobs == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		r.bgJobs.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		r.bgJobs.kill()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// bgJobs keeps track of the background jobs started by a Runner, so
+// that they can be waited for or killed.
+type bgJobs struct {
+	wg sync.WaitGroup
+
+	mu      sync.Mutex
+	lastID  int
+	cancels map[int]context.CancelFunc
+}
+
+// start registers a new background job, returning the context it must
+// run with and the func to call once it finishes.
+func (b *bgJobs) start(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(parent)
+	b.mu.Lock()
+	if b.cancels == nil {
+		b.cancels = make(map[int]context.CancelFunc)
+	}
+	b.lastID++
+	id := b.lastID
+	b.cancels[id] = cancel
+	b.mu.Unlock()
+	b.wg.Add(1)
+	return ctx, func() {
+		b.mu.Lock()
+		delete(b.cancels, id)
+		b.mu.Unlock()
+		cancel()
+		b.wg.Done()
+	}
+}
+
+// running returns the number of background jobs that haven't finished.
+func (b *bgJobs) running() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.cancels)
+}
+
+func (b *bgJobs) kill() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, cancel := range b.cancels {
+		cancel()
+	}
+}
+
 func (r *Runner) cmd(cm syntax.Command) {
 	if r.stop() {
 		return
@@ -721,7 +1240,8 @@ func (r *Runner) cmd(cm syntax.Command) {
 		fields := r.Fields(x.Args)
 		if len(fields) == 0 {
 			for _, as := range x.Assigns {
-				r.setVar(as.Name.Value, as.Index, r.assignValue(as, ""))
+				index, val := r.assignValue(as, "")
+				r.setVar(as.Name.Value, index, val)
 			}
 			break
 		}
@@ -730,19 +1250,21 @@ func (r *Runner) cmd(cm syntax.Command) {
 			r.cmdVars = make(map[string]varValue, len(x.Assigns))
 		}
 		for _, as := range x.Assigns {
-			r.cmdVars[as.Name.Value] = r.assignValue(as, "")
+			_, r.cmdVars[as.Name.Value] = r.assignValue(as, "")
 		}
 		r.call(x.Args[0].Pos(), fields[0], fields[1:])
 		r.cmdVars = oldVars
 	case *syntax.BinaryCmd:
 		switch x.Op {
 		case syntax.AndStmt:
-			r.stmt(x.X)
-			if r.exit == 0 {
-				r.stmt(x.Y)
+			r.stmtsNoErrExit(x.X)
+			if r.exit != 0 {
+				// the failure of X must not stop the program
+				return
 			}
+			r.stmt(x.Y)
 		case syntax.OrStmt:
-			r.stmt(x.X)
+			r.stmtsNoErrExit(x.X)
 			if r.exit != 0 {
 				r.stmt(x.Y)
 			}
@@ -750,12 +1272,17 @@ func (r *Runner) cmd(cm syntax.Command) {
 			pr, pw := io.Pipe()
 			r2 := r.sub()
 			r2.Stdout = pw
+			// only the last command in a pipeline counts
+			r2.noErrExit = true
 			if x.Op == syntax.PipeAll {
 				r2.Stderr = pw
 			} else {
 				r2.Stderr = r.Stderr
 			}
-			r.Stdin = pr
+			// don't leave the pipe as our stdin, as it's closed
+			// once the pipeline is done
+			oldIn, oldRedirected := r.Stdin, r.stdinRedirected
+			r.Stdin, r.stdinRedirected = pr, true
 			var wg sync.WaitGroup
 			wg.Add(1)
 			go func() {
@@ -764,12 +1291,13 @@ func (r *Runner) cmd(cm syntax.Command) {
 				wg.Done()
 			}()
 			r.stmt(x.Y)
+			r.Stdin, r.stdinRedirected = oldIn, oldRedirected
 			pr.Close()
 			wg.Wait()
 			r.setErr(r2.err)
 		}
 	case *syntax.IfClause:
-		r.stmts(x.Cond)
+		r.stmtsNoErrExit(x.Cond.Stmts...)
 		if r.exit == 0 {
 			r.stmts(x.Then)
 			return
@@ -778,7 +1306,7 @@ func (r *Runner) cmd(cm syntax.Command) {
 		r.stmts(x.Else)
 	case *syntax.WhileClause:
 		for r.err == nil {
-			r.stmts(x.Cond)
+			r.stmtsNoErrExit(x.Cond.Stmts...)
 			stop := (r.exit == 0) == x.Until
 			r.exit = 0
 			if stop || r.loopStmtsBroken(x.Do) {
@@ -822,12 +1350,7 @@ func (r *Runner) cmd(cm syntax.Command) {
 		str := r.loneWord(x.Word)
 		for _, ci := range x.Items {
 			for _, word := range ci.Patterns {
-				var buf bytes.Buffer
-				for _, field := range r.wordFields(word.Parts, false) {
-					escaped, _ := escapedGlob(field)
-					buf.WriteString(escaped)
-				}
-				if match(buf.String(), str) {
+				if match(r.pattern(word), str) {
 					r.stmts(ci.StmtList)
 					return
 				}
@@ -844,18 +1367,115 @@ func (r *Runner) cmd(cm syntax.Command) {
 			r.exit = 0
 		}
 	case *syntax.DeclClause:
-		mode := ""
-		for _, opt := range x.Opts {
-			_ = opt
-			switch s := r.loneWord(opt); s {
-			case "-n", "-A":
-				mode = s
+		r.declClause(x)
+	case *syntax.TimeClause:
+		start := time.Now()
+		if x.Stmt != nil {
+			r.stmt(x.Stmt)
+		}
+		real := time.Since(start)
+		// like in Bash, the report is not affected by the timed
+		// statement's redirections
+		r.errf("\n")
+		r.errf("real\t%s\n", elapsedString(real))
+		// TODO: can we do these?
+		r.errf("user\t0m0.000s\n")
+		r.errf("sys\t0m0.000s\n")
+	default:
+		r.runErr(cm.Pos(), "unhandled command node: %T", x)
+	}
+	if r.exit != 0 && r.stopOnCmdErr && !r.noErrExit {
+		r.lastExit()
+	}
+}
+
+func (r *Runner) cmdNoErrExit(cm syntax.Command) {
+	old := r.noErrExit
+	r.noErrExit = true
+	r.cmd(cm)
+	r.noErrExit = old
+}
+
+func (r *Runner) stmtsNoErrExit(stmts ...*syntax.Stmt) {
+	old := r.noErrExit
+	r.noErrExit = true
+	for _, stmt := range stmts {
+		r.stmt(stmt)
+	}
+	r.noErrExit = old
+}
+
+func (r *Runner) declClause(dc *syntax.DeclClause) {
+	r.exit = 0
+	mode := ""
+	exported := dc.Variant.Value == "export"
+	readOnly := dc.Variant.Value == "readonly"
+	local, print := false, false
+	switch dc.Variant.Value {
+	case "local":
+		if len(r.scopes) == 0 {
+			r.errf("local: can only be used in a function\n")
+			r.exit = 1
+			return
+		}
+		local = true
+	case "declare", "typeset":
+		// like local when used in a function
+		local = len(r.scopes) > 0
+	}
+	for _, opt := range dc.Opts {
+		s := r.loneWord(opt)
+		if len(s) < 2 || s[0] != '-' {
+			r.runErr(opt.Pos(), "unhandled declare opts")
+			continue
+		}
+		for _, c := range s[1:] {
+			switch c {
+			case 'a', 'A', 'n':
+				mode = "-" + string(c)
+			case 'x':
+				exported = true
+			case 'r':
+				readOnly = true
+			case 'g':
+				local = false
+			case 'p':
+				print = true
+			case '-':
 			default:
-				r.runErr(cm.Pos(), "unhandled declare opts")
+				r.runErr(opt.Pos(), "unhandled declare opts")
 			}
 		}
-		for _, as := range x.Assigns {
-			val := r.assignValue(as, mode)
+	}
+	if print {
+		r.printDecls(dc, exported, readOnly)
+		return
+	}
+	for _, as := range dc.Assigns {
+		if as.Name == nil {
+			// a word like "$name=value", only known
+			// once expanded
+			str := r.loneWord(as.Value)
+			as = &syntax.Assign{Naked: true, Name: &syntax.Lit{Value: str}}
+			if i := strings.IndexByte(str, '='); i > 0 {
+				as.Name.Value = str[:i]
+				as.Naked = false
+				as.Value = &syntax.Word{Parts: []syntax.WordPart{
+					&syntax.SglQuoted{Value: str[i+1:]},
+				}}
+			}
+		}
+		name := as.Name.Value
+		if !as.Naked && r.vars[name].readOnly {
+			r.errf("%s: %s: readonly variable\n", dc.Variant.Value, name)
+			r.exit = 1
+			continue
+		}
+		var index *varIndex
+		var val varValue
+		if !as.Naked {
+			// expanded before any local shadows name
+			index, val = r.assignValue(as, mode)
 			switch mode {
 			case "-n": // name reference
 				if name, ok := val.(string); ok {
@@ -864,27 +1484,118 @@ func (r *Runner) cmd(cm syntax.Command) {
 			case "-A":
 				// nothing to do
 			}
-			r.setVar(as.Name.Value, as.Index, val)
 		}
-	case *syntax.TimeClause:
-		start := time.Now()
-		if x.Stmt != nil {
-			r.stmt(x.Stmt)
+		if local {
+			r.declareLocal(name)
 		}
-		real := time.Since(start)
-		r.outf("\n")
-		r.outf("real\t%s\n", elapsedString(real))
-		// TODO: can we do these?
-		r.outf("user\t0m0.000s\n")
-		r.outf("sys\t0m0.000s\n")
-	default:
-		r.runErr(cm.Pos(), "unhandled command node: %T", x)
+		if !as.Naked {
+			r.setVar(name, index, val)
+		} else if _, ok := r.vars[name].value.(arrayMap); !ok && mode == "-A" {
+			// so that later indexes are not arithmetic
+			r.setVar(name, nil, arrayMap{vals: make(map[string]string)})
+		}
+		vr := r.vars[name]
+		vr.exported = vr.exported || exported
+		vr.readOnly = vr.readOnly || readOnly
+		r.vars[name] = vr
 	}
-	if r.exit != 0 && r.stopOnCmdErr {
-		r.lastExit()
+}
+
+// printDecls implements the -p option of the declaration builtins,
+// printing the variables in a form that can be parsed and run again.
+// If no names are given, all variables are printed, filtered by the
+// attributes that the builtin is about.
+func (r *Runner) printDecls(dc *syntax.DeclClause, exported, readOnly bool) {
+	var names []string
+	for _, as := range dc.Assigns {
+		if as.Name != nil {
+			names = append(names, as.Name.Value)
+		} else {
+			names = append(names, r.loneWord(as.Value))
+		}
+	}
+	if len(names) == 0 {
+		for name, vr := range r.vars {
+			if (exported && !vr.exported) || (readOnly && !vr.readOnly) {
+				continue
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	for _, name := range names {
+		vr, ok := r.vars[name]
+		if !ok {
+			r.errf("%s: %s: not found\n", dc.Variant.Value, name)
+			r.exit = 1
+			continue
+		}
+		if val, ok := r.dynamicVar(name); ok {
+			vr.value = val
+		}
+		r.outf("%s\n", declString(name, vr))
 	}
 }
 
+// declString returns a declare command that would recreate a variable
+// along with its attributes.
+func declString(name string, vr variable) string {
+	var flags, val bytes.Buffer
+	switch x := vr.value.(type) {
+	case string:
+		val.WriteString("=" + syntax.Quote(x))
+	case []string:
+		flags.WriteByte('a')
+		val.WriteString("=(")
+		for i, s := range x {
+			if i > 0 {
+				val.WriteByte(' ')
+			}
+			fmt.Fprintf(&val, "[%d]=%s", i, syntax.Quote(s))
+		}
+		val.WriteString(")")
+	case arrayMap:
+		flags.WriteByte('A')
+		val.WriteString("=(")
+		for i, k := range x.keys {
+			if i > 0 {
+				val.WriteByte(' ')
+			}
+			fmt.Fprintf(&val, "[%s]=%s", dblQuote(k), syntax.Quote(x.vals[k]))
+		}
+		val.WriteString(")")
+	case nameRef:
+		flags.WriteByte('n')
+		val.WriteString("=" + syntax.Quote(string(x)))
+	}
+	if vr.readOnly {
+		flags.WriteByte('r')
+	}
+	if vr.exported {
+		flags.WriteByte('x')
+	}
+	if flags.Len() == 0 {
+		flags.WriteByte('-')
+	}
+	return fmt.Sprintf("declare -%s %s%s", flags.String(), name, val.String())
+}
+
+// dblQuote quotes a string with double quotes, which is needed when
+// the parser only accepts double quotes, such as in array indexes.
+func dblQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '\\', '"', '$', '`':
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(r)
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
 func elapsedString(d time.Duration) string {
 	min := int(d.Minutes())
 	sec := math.Remainder(d.Seconds(), 60.0)
@@ -897,15 +1608,22 @@ func (r *Runner) stmts(sl syntax.StmtList) {
 	}
 }
 
-func match(pattern, name string) bool {
-	matched, _ := path.Match(pattern, name)
-	return matched
-}
-
 func (r *Runner) redir(rd *syntax.Redirect) (io.Closer, error) {
 	if rd.Hdoc != nil {
-		hdoc := r.loneWord(rd.Hdoc)
+		var hdoc string
+		if lit, ok := rd.Word.Parts[0].(*syntax.Lit); ok && len(rd.Word.Parts) == 1 &&
+			!strings.Contains(lit.Value, "\\") {
+			// unquoted delimiter, so expand as if double quoted
+			hdoc = r.loneWord(&syntax.Word{Parts: []syntax.WordPart{
+				&syntax.DblQuoted{Parts: rd.Hdoc.Parts},
+			}})
+		} else {
+			for _, part := range rd.Hdoc.Parts {
+				hdoc += part.(*syntax.Lit).Value
+			}
+		}
 		r.Stdin = strings.NewReader(hdoc)
+		r.stdinRedirected = true
 		return nil, nil
 	}
 	orig := &r.Stdout
@@ -920,6 +1638,7 @@ func (r *Runner) redir(rd *syntax.Redirect) (io.Closer, error) {
 	switch rd.Op {
 	case syntax.WordHdoc:
 		r.Stdin = strings.NewReader(arg + "\n")
+		r.stdinRedirected = true
 		return nil, nil
 	case syntax.DplOut:
 		switch arg {
@@ -950,6 +1669,7 @@ func (r *Runner) redir(rd *syntax.Redirect) (io.Closer, error) {
 	switch rd.Op {
 	case syntax.RdrIn:
 		r.Stdin = f
+		r.stdinRedirected = true
 	case syntax.RdrOut, syntax.AppOut:
 		*orig = f
 	case syntax.RdrAll, syntax.AppAll:
@@ -983,10 +1703,60 @@ type fieldPart struct {
 	quoted bool
 }
 
+// unescapeLit removes the backslashes in an unquoted literal, splitting
+// it so that the escaped characters are quoted.
+func unescapeLit(s string) []fieldPart {
+	if !strings.Contains(s, "\\") {
+		return []fieldPart{{val: s}}
+	}
+	var parts []fieldPart
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf.WriteByte(s[i])
+			continue
+		}
+		if buf.Len() > 0 {
+			parts = append(parts, fieldPart{val: buf.String()})
+			buf.Reset()
+		}
+		if i++; i < len(s) && s[i] != '\n' {
+			parts = append(parts, fieldPart{quoted: true, val: s[i : i+1]})
+		}
+	}
+	if buf.Len() > 0 {
+		parts = append(parts, fieldPart{val: buf.String()})
+	}
+	return parts
+}
+
+// unescapeDblQuoted removes the backslashes in a literal within double
+// quotes, where they only escape a few characters.
+func unescapeDblQuoted(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			switch s[i+1] {
+			case '\n':
+				i++
+				continue
+			case '$', '`', '"', '\\':
+				i++
+			}
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
 func (r *Runner) wordFields(wps []syntax.WordPart, quoted bool) [][]fieldPart {
 	var fields [][]fieldPart
 	var curField []fieldPart
-	allowEmpty := false
+	// flush ends the current field. Fields with no parts are dropped,
+	// while any quoted part, even if empty, makes a field.
 	flush := func() {
 		if len(curField) == 0 {
 			return
@@ -996,12 +1766,36 @@ func (r *Runner) wordFields(wps []syntax.WordPart, quoted bool) [][]fieldPart {
 	}
 	splitAdd := func(val string) {
 		// TODO: use IFS
-		for i, field := range strings.Fields(val) {
+		if val == "" {
+			return
+		}
+		split := strings.Fields(val)
+		if len(split) == 0 || strings.IndexByte(" \t\n", val[0]) >= 0 {
+			// leading separators end the field before
+			flush()
+		}
+		for i, field := range split {
 			if i > 0 {
 				flush()
 			}
 			curField = append(curField, fieldPart{val: field})
 		}
+		if len(split) > 0 && strings.IndexByte(" \t\n", val[len(val)-1]) >= 0 {
+			flush()
+		}
+	}
+	// quotedElems adds the quoted elements of "$@" or "${a[@]}",
+	// one per field. No elements result in no field at all.
+	quotedElems := func(elems []string) {
+		for i, elem := range elems {
+			if i > 0 {
+				flush()
+			}
+			curField = append(curField, fieldPart{
+				quoted: true,
+				val:    elem,
+			})
+		}
 	}
 	for i, wp := range wps {
 		switch x := wp.(type) {
@@ -1012,38 +1806,38 @@ func (r *Runner) wordFields(wps []syntax.WordPart, quoted bool) [][]fieldPart {
 				// TODO: ~someuser
 				s = r.getVar("HOME") + s[1:]
 			}
-			curField = append(curField, fieldPart{val: s})
+			curField = append(curField, unescapeLit(s)...)
 		case *syntax.SglQuoted:
-			allowEmpty = true
 			fp := fieldPart{quoted: true, val: x.Value}
 			if x.Dollar {
 				fp.val = r.expand(fp.val, true)
 			}
 			curField = append(curField, fp)
 		case *syntax.DblQuoted:
-			allowEmpty = true
-			if len(x.Parts) == 1 {
-				pe, _ := x.Parts[0].(*syntax.ParamExp)
-				if elems := r.quotedElems(pe); elems != nil {
-					for i, elem := range elems {
-						if i > 0 {
-							flush()
-						}
-						curField = append(curField, fieldPart{
-							quoted: true,
-							val:    elem,
-						})
-					}
-					continue
-				}
+			if len(x.Parts) == 0 {
+				curField = append(curField, fieldPart{quoted: true})
 			}
-			for _, field := range r.wordFields(x.Parts, true) {
-				for _, part := range field {
+			for _, part := range x.Parts {
+				switch part := part.(type) {
+				case *syntax.Lit:
 					curField = append(curField, fieldPart{
 						quoted: true,
-						val:    part.val,
+						val:    unescapeDblQuoted(part.Value),
 					})
+					continue
+				case *syntax.ParamExp:
+					if elems, ok := r.quotedElems(part); ok {
+						quotedElems(elems)
+						continue
+					}
 				}
+				val := ""
+				for _, field := range r.wordFields([]syntax.WordPart{part}, true) {
+					for _, part := range field {
+						val += part.val
+					}
+				}
+				curField = append(curField, fieldPart{quoted: true, val: val})
 			}
 		case *syntax.ParamExp:
 			val := r.paramExp(x)
@@ -1056,7 +1850,9 @@ func (r *Runner) wordFields(wps []syntax.WordPart, quoted bool) [][]fieldPart {
 			r2 := r.sub()
 			var buf bytes.Buffer
 			r2.Stdout = &buf
-			r2.stmts(x.StmtList)
+			if r2.nest(x.Pos()) {
+				r2.stmts(x.StmtList)
+			}
 			val := strings.TrimRight(buf.String(), "\n")
 			if quoted {
 				curField = append(curField, fieldPart{val: val})
@@ -1073,9 +1869,6 @@ func (r *Runner) wordFields(wps []syntax.WordPart, quoted bool) [][]fieldPart {
 		}
 	}
 	flush()
-	if allowEmpty && len(fields) == 0 {
-		fields = append(fields, []fieldPart{{}})
-	}
 	return fields
 }
 
@@ -1084,14 +1877,34 @@ type returnCode uint8
 func (returnCode) Error() string { return "returned" }
 
 func (r *Runner) call(pos syntax.Pos, name string, args []string) {
-	if body := r.funcs[name]; body != nil {
+	body := r.funcs[name]
+	if r.Metrics != nil {
+		kind := ProgramCommand
+		switch {
+		case body != nil:
+			kind = FuncCommand
+		case isBuiltin(name):
+			kind = BuiltinCommand
+		}
+		start := time.Now()
+		defer func() {
+			r.Metrics.Command(kind, name, r.exit, time.Since(start))
+		}()
+	}
+	if body != nil {
+		if !r.nest(pos) {
+			return
+		}
 		// stack them to support nested func calls
 		oldParams := r.Params
 		r.Params = args
 		r.canReturn = true
+		r.pushScope()
 		r.stmt(body)
+		r.popScope()
 		r.Params = oldParams
 		r.canReturn = false
+		r.depth--
 		if code, ok := r.err.(returnCode); ok {
 			r.err = nil
 			r.exit = int(code)
@@ -1112,6 +1925,9 @@ func (r *Runner) exec(name string, args []string) {
 		r.exit = 0
 	case ExitCode:
 		r.exit = int(x)
+	case *CommandError:
+		r.exit = int(x.Exit)
+		r.cmdErr = x
 	default:
 		r.setErr(err)
 	}
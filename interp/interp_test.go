@@ -7,8 +7,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -73,7 +76,7 @@ var fileCases = []struct {
 	{"printf", "usage: printf format [arguments]\nexit status 2 #JUSTERR"},
 	{"break", "break is only useful in a loop #JUSTERR"},
 	{"continue", "continue is only useful in a loop #JUSTERR"},
-	{"cd a b", "usage: cd [dir]\nexit status 2 #JUSTERR"},
+	{"cd a b", "usage: cd [-L|-P] [dir]\nexit status 2 #JUSTERR"},
 	{"shift a", "usage: shift [n]\nexit status 2 #JUSTERR"},
 	{"shouldnotexist", "exit status 127 #JUSTERR"},
 	{
@@ -111,6 +114,28 @@ var fileCases = []struct {
 	{"printf %o -3", "1777777777777777777775"},
 	{"printf %x -3", "fffffffffffffffd"},
 	{"printf %c,%c,%c foo àa", "f,\xc3,\x00"}, // TODO: use a rune?
+	{"printf %s-%s, 1 2 3", "1-2,3-,"},
+	{"printf '%d%%\\n' 50", "50%\n"},
+	{"printf 'x\\101\\0y' a b", "xA\x00y"},
+	{"printf -v a '%s\\n' x y; echo \"<$a>\"", "<x\ny\n>\n"},
+	{"printf -v 1a x", "printf: `1a': not a valid identifier\nexit status 2 #JUSTERR"},
+
+	// read
+	{`read a b <<< "  x  y  z  "; echo "<$a><$b>"`, "<x><y  z>\n"},
+	{`read <<< "  x \\y  "; echo "<$REPLY>"`, "<  x y  >\n"},
+	{`IFS= read -r a <<< "  x \\ y  "; echo "<$a>"`, "<  x \\ y  >\n"},
+	{`printf 'a\\\nb \\\n' | { read a b; echo "<$a><$b>"; }`, "<ab><>\n"},
+	{
+		`IFS=: read a b <<< "x:y:"; IFS=: read c d <<< "x:y::"; echo "<$a><$b><$c><$d>"`,
+		"<x><y><x><y::>\n",
+	},
+	{`IFS=": " read a b c <<< " x : y : z "; echo "<$a><$b><$c>"`, "<x><y><z>\n"},
+	{`printf 'a b' | { read x y; echo $? "<$x><$y>"; }`, "1 <a><b>\n"},
+	{`printf 'one\0two\0' | { read -r -d '' a; read -r -d '' b; echo "<$a><$b>"; }`, "<one><two>\n"},
+	{`printf 'a;b\nc' | { read -d ';' x; echo "<$x>"; cat; }`, "<a>\nb\nc"},
+	{`printf 'l1\nl2\n' | while read -r l; do echo "[$l]"; done`, "[l1]\n[l2]\n"},
+	{"read -x", "read: -x: invalid option\nexit status 2 #JUSTERR"},
+	{"read 1a <<< x", "read: `1a': not a valid identifier\nexit status 1 #JUSTERR"},
 
 	// words and quotes
 	{"echo  foo ", "foo\n"},
@@ -145,6 +170,40 @@ var fileCases = []struct {
 	{"env | grep '^INTERP_GLOBAL='", "INTERP_GLOBAL=value\n"},
 	{"a=b; a+=c x+=y; echo $a $x", "bc y\n"},
 
+	// exported vars
+	{"foo=bar; export foo; env | grep '^foo='", "foo=bar\n"},
+	{"export foo=bar; env | grep '^foo='", "foo=bar\n"},
+	{"export foo; foo=bar; env | grep '^foo='", "foo=bar\n"},
+	{"declare -x foo=bar; env | grep '^foo='", "foo=bar\n"},
+	{"export foo; env | grep '^foo='", "exit status 1"},
+	{"foo=(a b); export foo; env | grep '^foo='", "exit status 1"},
+	{"INTERP_GLOBAL=x; env | grep '^INTERP_GLOBAL='", "INTERP_GLOBAL=x\n"},
+	{"unset INTERP_GLOBAL; env | grep '^INTERP_GLOBAL='", "exit status 1"},
+	{"foo=bar; foo=x env | grep '^foo='", "foo=x\n"},
+	{`name=foo; export "$name=bar"; echo $foo`, "bar\n"},
+
+	// local vars and dynamic scoping
+	{"f() { local a=inner; echo $a; }; a=outer; f; echo $a", "inner\nouter\n"},
+	{"f() { local a=$a; echo $a; a=x; }; a=outer; f; echo $a", "outer\nouter\n"},
+	{"f() { local a; echo ${a-unset}; a=x; }; a=outer; f; echo $a", "unset\nouter\n"},
+	{"f() { local a; [[ -v a ]]; }; f", "exit status 1"},
+	{"f() { local a=1; g; }; g() { echo $a; a=2; }; a=0; f; echo $a", "1\n0\n"},
+	{"f() { declare a=1; declare -g b=2; }; f; echo [$a][$b]", "[][2]\n"},
+	{"f() { local a; a=1; }; f; echo ${a-unset}", "unset\n"},
+	{
+		"f() { local a=inner; unset a; echo ${a-unset}; a=2; }; a=outer; f; echo $a",
+		"unset\nouter\n",
+	},
+	{
+		"g() { unset a; echo g $a; }; f() { local a=inner; g; echo f $a; }; a=outer; f; echo $a",
+		"g outer\nf outer\nouter\n",
+	},
+	{
+		"g() { unset a; echo g ${a-unset}; }; f() { local a=inner; g; }; f; echo ${a-unset}",
+		"g unset\nunset\n",
+	},
+	{"local a=b", "local: can only be used in a function\nexit status 1 #JUSTERR"},
+
 	// special vars
 	{"echo $?; false; echo $?", "0\n1\n"},
 
@@ -171,6 +230,22 @@ var fileCases = []struct {
 		"a=foo; echo ${a/no/x}; echo ${a/o/i}; echo ${a//o/i}; echo ${a/fo/}",
 		"foo\nfio\nfii\no\n",
 	},
+	{
+		"a=foobarfoo; echo ${a/o*/x} ${a//[ao]/x} ${a/#foo/x} ${a/%foo/x} ${a/%o/x} ${a/#o/x}",
+		"fx fxxbxrfxx xbarfoo foobarx foobarfox foobarfoo\n",
+	},
+	{
+		`a='a*b'; p='o*'; echo ${a/"*"/-} ${a/\*/-} ${a/"#"/-} ${a/#/-} ${a/%/-} ${a#$p} ${a#"a*"}`,
+		"a-b a-b a*b -a*b a*b- a*b b\n",
+	},
+	{
+		`a=foobar; p='o*'; echo ${a/$p/-} ${a/"$p"/-}; p='a\*'; a='a*b'; echo ${a/$p/-}`,
+		"f- foobar\n-b\n",
+	},
+	{
+		`a=abcabc; p='b*'; echo ${a%$p} ${a%%$p} ${a%"$p"} ${a#*"b"}`,
+		"abca a abcabc cabc\n",
+	},
 	{
 		"echo ${a:-b}; echo $a; a=; echo ${a:-b}; a=c; echo ${a:-b}",
 		"b\n\nb\nc\n",
@@ -437,6 +512,42 @@ var fileCases = []struct {
 		`mkdir a; ln -s a b; [[ $(cd a && pwd) == $(cd b && pwd) ]]; echo $?`,
 		"1\n",
 	},
+	{
+		`mkdir -p a/b; ln -s a/b c; cd c; echo ${PWD##*/}; pwd -P | sed 's@.*/a/@@'; cd ..; [[ -d a ]] && echo ok`,
+		"c\nb\nok\n",
+	},
+	{
+		`mkdir -p a/b; ln -s a/b c; cd -P c; echo ${PWD##*/}; cd ..; echo ${PWD##*/}`,
+		"b\na\n",
+	},
+	{
+		`mkdir -p a/b; ln -s a/b c; cd -L c; cd -P ..; echo ${PWD##*/}`,
+		"a\n",
+	},
+	{
+		`old=$PWD; mkdir a; cd a; [[ $OLDPWD == $old ]] && cd - >/dev/null && [[ $PWD == $old ]]`,
+		"",
+	},
+	{
+		`old=$PWD; mkdir a; cd a; [[ $(cd -) == $old ]] && echo ok`,
+		"ok\n",
+	},
+	{
+		"unset OLDPWD; cd -",
+		"cd: OLDPWD not set\nexit status 1 #JUSTERR",
+	},
+	{
+		`mkdir -p a/foo; CDPATH=:a; cd foo | sed 's@.*/a/@@'; cd foo >/dev/null; echo ${PWD##*/}`,
+		"foo\nfoo\n",
+	},
+	{
+		`mkdir -p a/foo foo; CDPATH=a; cd foo >/dev/null; [[ $PWD == */a/foo ]] && echo ok`,
+		"ok\n",
+	},
+	{
+		"mkdir -p a/foo; CDPATH=a; cd ./foo",
+		"exit status 1 #JUSTERR",
+	},
 	{
 		`mkdir a; chmod 0000 a; cd a`,
 		"exit status 1 #JUSTERR",
@@ -585,6 +696,14 @@ var fileCases = []struct {
 		"case foo in '*') echo x ;; f*) echo y ;; esac",
 		"y\n",
 	},
+	{
+		`p='f*'; case foo in "$p") echo x ;; $p) echo y ;; esac`,
+		"y\n",
+	},
+	{
+		`p='a b'; case 'a b' in $p) echo x ;; esac; [[ 'a b' == $p ]] && echo y`,
+		"x\ny\n",
+	},
 
 	// exec
 	{
@@ -625,6 +744,7 @@ var fileCases = []struct {
 	{"foo() { :; }; command -v does-not-exist foo", "foo\n"},
 	{"command -v echo", "echo\n"},
 	{"[[ $(command -v bash) == bash ]]", "exit status 1"},
+	{"PATH=/nonexistent command -v bash", "exit status 1"},
 
 	// cmd substitution
 	{
@@ -968,6 +1088,13 @@ var fileCases = []struct {
 	{"[[ -o wrong ]]", "exit status 1"},
 	{"[[ -o errexit ]]", "exit status 1"},
 	{"set -e; [[ -o errexit ]]", ""},
+	{"set -e; ! false; echo still", "still\n"},
+	{"set -e; false | true; echo still", "still\n"},
+	{"set -e; false && true; echo still", "still\n"},
+	{"set -e; true && false; echo notreached", "exit status 1"},
+	{"set -e; if false; then :; fi; echo still", "still\n"},
+	{"set -e; while false; do :; done; echo still", "still\n"},
+	{"set -e; f() { false; echo in; }; ! f; echo still", "in\nstill\n"},
 
 	// classic test
 	{
@@ -1121,6 +1248,44 @@ var fileCases = []struct {
 		"2\n",
 	},
 
+	// subshell depth
+	{
+		"echo $BASH_SUBSHELL; (echo $BASH_SUBSHELL; (echo $BASH_SUBSHELL))",
+		"0\n1\n2\n",
+	},
+	{
+		"echo $(echo $BASH_SUBSHELL) $( (echo $BASH_SUBSHELL) )",
+		"1 2\n",
+	},
+	{
+		"{ echo $BASH_SUBSHELL; } | cat; { echo $BASH_SUBSHELL; } & wait",
+		"1\n1\n",
+	},
+	{
+		"echo $((BASH_SUBSHELL + 1)); (echo $((BASH_SUBSHELL + 1)))",
+		"1\n2\n",
+	},
+
+	// empty fields
+	{`set -- "" "$unset" $unset ''; echo $#`, "3\n"},
+	{`set -- a""b $unset""; echo $# "$1" "$2"`, "2 ab \n"},
+	{`set -- "$@"; echo $#; set -- "$@"""; echo $#`, "0\n1\n"},
+	{`set -- x"$@" "x$@y"; echo $# $@`, "2 x xy\n"},
+	{
+		`set -- 1 "2 3" ""; for a in "$@" "x$@y"; do echo "<$a>"; done`,
+		"<1>\n<2 3>\n<>\n<x1>\n<2 3>\n<y>\n",
+	},
+	{`set -- 1 "2 3" ""; set -- $@; echo $#; set -- "$*"; echo "<$1>"`, "3\n<1 2 3>\n"},
+	{`x=" a "; set -- $x""; echo $# "<$1>" "<$2>"`, "2 <a> <>\n"},
+	{`x=" a "; set -- ""$x; echo $# "<$1>" "<$2>"`, "2 <> <a>\n"},
+	{`y=" " e=; set -- a$y"b" a$e"b" $e$e "$e$e"; echo $# $1 $2 $3`, "4 a b ab\n"},
+	{`a=(); set -- "${a[@]}" "${unset[@]}"; echo $#`, "0\n"},
+	{
+		`a=("" a); for x in "${a[@]}" x"${a[@]}"y; do echo "<$x>"; done`,
+		"<>\n<a>\n<x>\n<ay>\n",
+	},
+	{`set -- $(echo) "$(echo)" $(echo " x ")""; echo $# "<$2>"`, "3 <x>\n"},
+
 	// set/shift
 	{
 		"echo $#; set foo bar; echo $#",
@@ -1150,6 +1315,18 @@ var fileCases = []struct {
 		`set -e; set +e; false; echo foo`,
 		"foo\n",
 	},
+	{"set a b c; set --; echo $# \"$*\"", "0 \n"},
+	{"set -- a b; set -e; echo $# $@", "2 a b\n"},
+	{"set -- a b; set -e c; echo $# $@", "1 c\n"},
+	{"set -- a b; set - x y; echo $# $@", "2 x y\n"},
+	{"set -- -e; echo $# $1", "1 -e\n"},
+	{`echo "<$SHELLOPTS>"; set -e; echo $SHELLOPTS`, "<>\nerrexit\n"},
+	{"shopt -s nullglob; echo $BASHOPTS; shopt -u nullglob; echo \"<$BASHOPTS>\"", "nullglob\n<>\n"},
+	{"unset SHELLOPTS", "unset: SHELLOPTS: cannot unset: readonly variable\nexit status 1 #JUSTERR"},
+	{
+		"set -- a b; f() { set -- x; echo $# $1; }; f 1 2 3; echo $# $1",
+		"1 x\n2 a\n",
+	},
 
 	// builtin
 	{"builtin", ""},
@@ -1270,6 +1447,21 @@ var fileCases = []struct {
 		"c d\n",
 	},
 
+	// array subscript side effects
+	{"i=0; a[i++]=x; a[i++]=y; echo ${a[@]} $i", "x y 2\n"},
+	{"i=0; a=(x y z); echo ${a[i++]} ${a[i++]} $i", "x y 2\n"},
+	{"i=0; a=(1 2 3); a[i++]+=5; echo ${a[@]} $i", "15 2 3 1\n"},
+	{"i=0; a=(1 2 3); echo $((a[i++] + a[i++])) $i", "3 2\n"},
+	{"i=0; a=(1 2 3); ((a[i++]++)); echo ${a[@]} $i", "2 2 3 1\n"},
+	{"i=0; a=(1 2 3); ((a[i++] += 10)); echo ${a[@]} $i", "11 2 3 1\n"},
+	{"i=0; a[i++]=$i; echo ${a[@]} $i", "0 1\n"},
+	{"i=0; declare a[i++]=x; echo ${a[@]} $i", "x 1\n"},
+	{"i=0; a=(1 2 3); declare -n r=a; echo ${r[i++]} $i", "1 1\n"},
+	{"i=0; a=([i++]=x [i++]=y); echo ${a[@]} $i", "x y 2\n"},
+	{"a=([2]=x y); echo ${a[3]}", "y\n"},
+	{"a=(x y); a[-1]=z; echo ${a[@]}", "x z\n"},
+	{"i=0; declare -A m; m[i++]=x; echo ${m[@]} $i", "x 0\n"},
+
 	// declare
 	{
 		"declare a=b c=(1 2); echo $a; echo ${c[@]}",
@@ -1299,6 +1491,49 @@ var fileCases = []struct {
 		"declare -n foo=bar bar=foo; echo $foo",
 		"\n #IGNORE",
 	},
+	{
+		`a="x y'z"; declare -p a; declare b; declare -p b`,
+		"declare -- a='x y'\\''z'\ndeclare -- b\n #IGNORE",
+	},
+	{
+		`a=(1 "b c"); declare -A m=([k]=v ["a b"]=x); declare -p a m`,
+		"declare -a a=([0]=1 [1]='b c')\ndeclare -A m=([\"k\"]=v [\"a b\"]=x)\n #IGNORE",
+	},
+	{
+		"readonly r=1; export e=2; declare -n n=e; declare -p r e n",
+		"declare -r r=1\ndeclare -x e=2\ndeclare -n n=e\n #IGNORE",
+	},
+	{
+		"readonly c=3 d; readonly -p",
+		"declare -r BASHOPTS=''\ndeclare -r SHELLOPTS=''\ndeclare -r c=3\ndeclare -r d\n #IGNORE",
+	},
+	{
+		"readonly a=1; declare a=2; echo $? $a; f() { local a=3; }; f; echo $a",
+		"declare: a: readonly variable\n1 1\nlocal: a: readonly variable\n1\n #JUSTERR",
+	},
+	{"declare -p nope", "declare: nope: not found\nexit status 1 #JUSTERR"},
+	{"f() { declare -p a; }; a=x; f >/dev/null; echo $?", "0\n"},
+	{
+		`a="x y'z"; s=$(declare -p a); unset a; eval "$s"; echo "$a"`,
+		"x y'z\n",
+	},
+	{
+		`a=(x "y z"); s=$(declare -p a); unset a; eval "$s"; echo ${a[1]}`,
+		"y z\n",
+	},
+	{
+		`declare -A m=(["x y"]="a b" [z]='$c'); s=$(declare -p m); unset m; eval "$s"; echo ${m["x y"]} ${m["z"]}`,
+		"a b $c\n",
+	},
+	{
+		"f() { export a=1; readonly b=2; }; f; s=$(declare -p a b); unset a; eval \"$s\" 2>/dev/null; env | grep '^a='",
+		"a=1\n",
+	},
+	{"readonly a=1; a=2; echo foo", "a: readonly variable\nexit status 1 #JUSTERR"},
+	{
+		"readonly a=1; unset a; echo $? $a",
+		"unset: a: cannot unset: readonly variable\n1 1\n #JUSTERR",
+	},
 
 	// glob
 	{"echo .", ".\n"},
@@ -1324,6 +1559,29 @@ var fileCases = []struct {
 		"mkdir a; touch a/b.x; echo */*.x; cd a; echo *.x",
 		"a/b.x\nb.x\n",
 	},
+	{
+		"mkdir a; cd a; mkdir b; touch .x b/c; echo *; echo .*; echo */; echo ./b/* b/c/*",
+		"b\n.x\nb/\n./b/c b/c/*\n",
+	},
+	{
+		"shopt -s nullglob; echo foo *.x bar; a=*.x; echo \"$a\"",
+		"foo bar\n*.x\n",
+	},
+	{
+		"shopt nullglob; shopt -s nullglob; shopt -p nullglob; shopt -q nullglob",
+		"nullglob       \toff\nshopt -s nullglob\n",
+	},
+	{"shopt -s foo", "shopt: foo: invalid shell option name\nexit status 1 #JUSTERR"},
+
+	// pattern matching never uses the filesystem
+	{
+		"shopt -s nullglob; case x.y in *.x) echo a ;; *.y) echo b ;; esac",
+		"b\n",
+	},
+	{"[[ a/b == a* ]] && [[ .a == * ]] && [[ x != *.x ]]", ""},
+	{"[[ ab == [!a]* ]]", "exit status 1"},
+	{"case ] in []]) echo y ;; esac; [[ b == [[:alpha:]] ]]", "y\n"},
+	{"[[ 'a]' == *] ]] && [[ '[' == [ ]]", ""},
 
 	// /dev/null
 	{"echo foo >/dev/null", ""},
@@ -1331,6 +1589,11 @@ var fileCases = []struct {
 
 	// time - real would be slow and flaky; see TestElapsedString
 	{"{ time; } |& wc", "      4       6      42\n"},
+	{"{ time echo foo | tr o x; } 2>/dev/null", "fxx\n"},
+	{"{ time true 2>/dev/null; } 2>&1 | grep -c real", "1\n"},
+	{"{ ! time false; } 2>/dev/null; echo $?", "0\n"},
+	{"{ time false | true; } 2>/dev/null; echo $?", "0\n"},
+	{"set -e; { ! time false; } 2>/dev/null; echo still", "still\n"},
 
 	// exec
 	{"exec", ""},
@@ -1390,6 +1653,9 @@ func TestFile(t *testing.T) {
 			if err := r.Run(file); err != nil {
 				cb.WriteString(err.Error())
 			}
+			if n := r.bgJobs.running(); n > 0 {
+				t.Errorf("%d background jobs leaked by %q", n, c.in)
+			}
 			want := c.want
 			if i := strings.Index(want, " #JUSTERR"); i >= 0 {
 				want = want[:i]
@@ -1475,6 +1741,71 @@ func TestRunnerOpts(t *testing.T) {
 			"env | grep '^a=' | tail -n 1; echo $a",
 			"a=c\nc\n",
 		},
+		{
+			Runner{NoInheritEnv: true},
+			"env | grep '^INTERP_GLOBAL='; echo $INTERP_GLOBAL",
+			"value\n",
+		},
+		{
+			Runner{NoInheritEnv: true},
+			"export INTERP_GLOBAL; env | grep '^INTERP_GLOBAL='",
+			"INTERP_GLOBAL=value\n",
+		},
+		{
+			Runner{Env: []string{"a=1", "b=x y"}, NoInheritEnv: true},
+			"export a; c=2; export -p",
+			"declare -x a=1\n",
+		},
+		{
+			Runner{Env: []string{"a=1", "b=x y"}},
+			"export -p; declare -p b",
+			"declare -x SHLVL=1\ndeclare -x a=1\ndeclare -x b='x y'\ndeclare -x b='x y'\n",
+		},
+		{
+			Runner{Env: []string{"SHELLOPTS=braceexpand:errexit", "BASHOPTS=nullglob"}},
+			"echo $SHELLOPTS $BASHOPTS; env | grep OPTS=; false; echo foo",
+			"errexit nullglob\nBASHOPTS=nullglob\nSHELLOPTS=errexit\nexit status 1",
+		},
+		{
+			Runner{Env: []string{"SHELLOPTS="}},
+			"set -e; env | grep '^SHELLOPTS='; SHELLOPTS=",
+			"SHELLOPTS=errexit\nSHELLOPTS: readonly variable\nexit status 1",
+		},
+		{
+			Runner{Env: []string{"SHLVL=3"}},
+			"echo $SHLVL; env | grep '^SHLVL='",
+			"4\nSHLVL=4\n",
+		},
+		{
+			Runner{Env: []string{"SHLVL=foo"}},
+			"echo $SHLVL",
+			"1\n",
+		},
+		{
+			Runner{Env: []string{"SHLVL=-5"}},
+			"echo $SHLVL",
+			"0\n",
+		},
+		{
+			Runner{Stdin: strings.NewReader("foo\n")},
+			"cat & wait; cat",
+			"foo\n",
+		},
+		{
+			Runner{Stdin: strings.NewReader("foo\n"), BackgroundStdin: true},
+			"cat & wait",
+			"foo\n",
+		},
+		{
+			Runner{Stdin: strings.NewReader("foo\n")},
+			"echo bar | { cat & wait; }; cat <<<baz & wait",
+			"bar\nbaz\n",
+		},
+		{
+			Runner{Stdin: strings.NewReader("foo\n")},
+			"echo bar | cat; cat",
+			"bar\nfoo\n",
+		},
 		{
 			Runner{Env: []string{"foo"}},
 			"",
@@ -1555,6 +1886,63 @@ func TestRunnerContext(t *testing.T) {
 	}
 }
 
+func TestRunnerWait(t *testing.T) {
+	p := syntax.NewParser()
+	run := func(r *Runner, in string) {
+		file, err := p.Parse(strings.NewReader(in), "")
+		if err != nil {
+			t.Fatalf("could not parse: %v", err)
+		}
+		r.Reset()
+		if err := r.Run(file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Run("Finish", func(t *testing.T) {
+		var cb concBuffer
+		r := &Runner{Stdout: &cb, Stderr: &cb}
+		run(r, "{ sleep 0.01; echo foo; } &")
+		if err := r.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := r.bgJobs.running(); n > 0 {
+			t.Fatalf("%d background jobs still running", n)
+		}
+		if got, want := cb.String(), "foo\n"; got != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	})
+	t.Run("Kill", func(t *testing.T) {
+		r := &Runner{}
+		run(r, "sleep 1000 & while true; do true; done &")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		errChan := make(chan error)
+		go func() {
+			errChan <- r.Wait(ctx)
+		}()
+		select {
+		case err := <-errChan:
+			if err != ctx.Err() {
+				t.Fatalf("want %v, got %v", ctx.Err(), err)
+			}
+		case <-time.After(time.Millisecond * 100):
+			t.Fatal("background jobs were not killed in 0.1s")
+		}
+		if n := r.bgJobs.running(); n > 0 {
+			t.Fatalf("%d background jobs still running", n)
+		}
+	})
+	t.Run("WaitBackground", func(t *testing.T) {
+		var cb concBuffer
+		r := &Runner{Stdout: &cb, Stderr: &cb, WaitBackground: true}
+		run(r, "{ sleep 0.01; echo foo; } &")
+		if got, want := cb.String(), "foo\n"; got != want {
+			t.Fatalf("want %q, got %q", want, got)
+		}
+	})
+}
+
 func TestRunnerAltNodes(t *testing.T) {
 	in := "echo foo"
 	want := "foo\n"
@@ -1584,6 +1972,279 @@ func TestRunnerAltNodes(t *testing.T) {
 	}
 }
 
+func TestRunnerStmts(t *testing.T) {
+	in := "a=foo\necho $a\nexit 3\necho bar\n("
+	want := "foo\n"
+	var cb concBuffer
+	r := Runner{
+		Stdout: &cb,
+		Stderr: &cb,
+	}
+	r.Reset()
+	var runErr error
+	err := syntax.NewParser().Stmts(strings.NewReader(in), func(s *syntax.Stmt) bool {
+		runErr = r.Stmt(s)
+		return runErr == nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected parse error: %v", err)
+	}
+	if runErr != ExitCode(3) {
+		t.Fatalf("wrong error: want exit status 3, got %v", runErr)
+	}
+	if got := cb.String(); got != want {
+		t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", in, want, got)
+	}
+}
+
+func TestRunnerFormat(t *testing.T) {
+	arg := "a b; echo $HOME *"
+	file, err := syntax.Format("prog %s x%s", arg, arg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	r := Runner{
+		Exec: func(ctx Ctxt, name string, args []string) error {
+			got = append(got, append([]string{name}, args...))
+			return nil
+		},
+	}
+	r.Reset()
+	if err := r.Run(file); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"prog", arg, "x" + arg}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong arguments:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+type failReader struct{ t *testing.T }
+
+func (f failReader) Read(p []byte) (int, error) {
+	f.t.Fatal("read past the end of the program")
+	return 0, nil
+}
+
+func TestRunnerReader(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"echo foo\nexit 3\n", "foo\nexit status 3"},
+		{"echo foo\nfalse\n", "foo\nexit status 1"},
+		{"echo foo\n(\n", "foo\nf.sh:2:1: reached EOF without matching ( with )"},
+	}
+	for _, tc := range tests {
+		var cb concBuffer
+		r := Runner{
+			Stdout: &cb,
+			Stderr: &cb,
+		}
+		r.Reset()
+		var rd io.Reader = strings.NewReader(tc.in)
+		if strings.Contains(tc.in, "exit") {
+			rd = io.MultiReader(rd, failReader{t})
+		}
+		if err := r.RunReader(context.Background(), rd, "f.sh"); err != nil {
+			cb.WriteString(err.Error())
+		}
+		if got := cb.String(); got != tc.want {
+			t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+				tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestAssignments(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+		err  string
+	}{
+		{"a=b", map[string]string{"a": "b"}, ""},
+		{"# comment\nexport A=1 B='two words'\nreadonly C=\"$A-$B\"", map[string]string{
+			"A": "1", "B": "two words", "C": "1-two words",
+		}, ""},
+		{"a=$BASE/x; b=$((2+3)); c=${a#/}", map[string]string{
+			"a": "/base/x", "b": "5", "c": "base/x",
+		}, ""},
+		{"a=1; echo rm -rf /; a=2 b=3 cmd; a+=x", map[string]string{"a": "1x"}, ""},
+		{"a=1 >f; arr=(x y); if true; then b=2; fi; local c=3", map[string]string{}, ""},
+		{"a=1\nb=$(rm foo)", nil, "env:2:3: commands cannot be run in this context"},
+		{"a=`id`", nil, "env:1:3: commands cannot be run in this context"},
+		{"readonly a=1; a=2", nil, "a: readonly variable"},
+		{"a=${b?is unset}", nil, "is unset"},
+	}
+	p := syntax.NewParser()
+	for _, tc := range tests {
+		f, err := p.Parse(strings.NewReader(tc.in), "env")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Assignments(f, []string{"BASE=/base"})
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("wrong error in %q:\nwant: %q\ngot:  %v", tc.in, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error in %q: %v", tc.in, err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("wrong vars in %q:\nwant: %v\ngot:  %v", tc.in, tc.want, got)
+		}
+	}
+}
+
+type mapVars map[string]string
+
+func (m mapVars) Get(name string) (string, bool) {
+	val, ok := m[name]
+	return val, ok
+}
+
+func (m mapVars) Set(name, value string) { m[name] = value }
+
+func TestEvalArithm(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+		vars string // after evaluating, as sorted k=v pairs
+		err  string
+	}{
+		{"(x+3)*2", 10, "x=2 y=z", ""},
+		{"y", 7, "x=2 y=z", ""},
+		{"x++ + ++x", 6, "x=4 y=z", ""},
+		{"n = x << 2, n", 8, "n=8 x=2 y=z", ""},
+		{"unset + $x * ${#y}", 2, "x=2 y=z", ""},
+		{"1 + $(echo 3)", 0, "", "1:5: commands cannot be run in this context"},
+		{"${x?}", 2, "x=2 y=z", ""},
+		{"${u?not set}", 0, "", "not set"},
+	}
+	p := syntax.NewParser()
+	for _, tc := range tests {
+		expr, err := p.Arithmetic(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := mapVars{"x": "2", "y": "z", "z": "7"}
+		got, err := EvalArithm(expr, vars)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("wrong error in %q:\nwant: %s\ngot:  %v", tc.in, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error in %q: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("wrong result in %q: want %d, got %d", tc.in, tc.want, got)
+		}
+		delete(vars, "z")
+		var pairs []string
+		for k, v := range vars {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		if tc.vars != "" && strings.Join(pairs, " ") != tc.vars {
+			t.Fatalf("wrong vars after %q:\nwant: %s\ngot:  %s", tc.in, tc.vars, strings.Join(pairs, " "))
+		}
+	}
+}
+
+type fakeInfo struct {
+	name string
+	mode os.FileMode
+	size int64
+}
+
+func (fi fakeInfo) Name() string       { return fi.name }
+func (fi fakeInfo) Size() int64        { return fi.size }
+func (fi fakeInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeInfo) Sys() interface{}   { return nil }
+
+type mapFS map[string]fakeInfo
+
+func (fs mapFS) Lstat(name string) (os.FileInfo, error) {
+	if fi, ok := fs[name]; ok {
+		return fi, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (fs mapFS) Stat(name string) (os.FileInfo, error) {
+	fi, err := fs.Lstat(name)
+	if err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return fs.Lstat(fi.Name())
+	}
+	return fi, err
+}
+
+func TestEvalTest(t *testing.T) {
+	fs := mapFS{
+		"/etc":        {"etc", os.ModeDir | 0755, 0},
+		"/etc/passwd": {"passwd", 0644, 100},
+		"/bin/sh":     {"sh", 0755, 100},
+		"/empty":      {"empty", 0444, 0},
+		"/link":       {"/bin/sh", os.ModeSymlink | 0777, 0},
+	}
+	tests := []struct {
+		in   string
+		want bool
+		vars string // after evaluating, as sorted k=v pairs
+		err  string
+	}{
+		{"-d /etc && -f etc/passwd", true, "", ""},
+		{"-e /nonexistent || -d /etc/passwd", false, "", ""},
+		{"-x /bin/sh && ! -x /etc/passwd && -x $f", true, "", ""},
+		{"-s /etc/passwd && ! -s /empty", true, "", ""},
+		{"-r /empty && ! -w /empty", true, "", ""},
+		{"-L /link && -x /link && ! -L /bin/sh", true, "", ""},
+		{"$x == ba* && $x != *z", true, "", ""},
+		{"$x == \"ba*\"", false, "", ""},
+		{"$n -gt 3 && $n -le 10", true, "", ""},
+		{"$x =~ ^b(a|o)r$ && $x < baz", true, "", ""},
+		{"-v x && ! -v u && -z $u && -n ${u:=set}", true, "f=/bin/sh n=10 u=set x=bar", ""},
+		{"$x =~ (", false, "", "invalid regular expression"},
+		{"-n $(echo foo)", false, "", "1:4: commands cannot be run in this context"},
+		{"-n ${u?not set}", false, "", "not set"},
+	}
+	p := syntax.NewParser()
+	for _, tc := range tests {
+		expr, err := p.Test(strings.NewReader(tc.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		vars := mapVars{"x": "bar", "n": "10", "f": "/bin/sh"}
+		got, err := EvalTest(expr, vars, fs)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Fatalf("wrong error in %q:\nwant: %s\ngot:  %v", tc.in, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected error in %q: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Fatalf("wrong result in %q: want %t, got %t", tc.in, tc.want, got)
+		}
+		var pairs []string
+		for k, v := range vars {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		if tc.vars != "" && strings.Join(pairs, " ") != tc.vars {
+			t.Fatalf("wrong vars after %q:\nwant: %s\ngot:  %s", tc.in, tc.vars, strings.Join(pairs, " "))
+		}
+	}
+}
+
 func TestElapsedString(t *testing.T) {
 	tests := []struct {
 		in   time.Duration
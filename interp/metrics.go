@@ -0,0 +1,136 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommandKind is the kind of a simple command reported to Metrics.
+type CommandKind uint8
+
+const (
+	BuiltinCommand CommandKind = iota
+	FuncCommand
+	ProgramCommand
+)
+
+func (k CommandKind) String() string {
+	switch k {
+	case BuiltinCommand:
+		return "builtin"
+	case FuncCommand:
+		return "func"
+	default:
+		return "program"
+	}
+}
+
+// Metrics is told by a Runner about each simple command it runs, for
+// example to count and time them as Prometheus metrics. Its methods may
+// be called concurrently, as pipelines and background jobs run commands
+// in parallel.
+type Metrics interface {
+	// Command is called once a command has finished, with its exit
+	// status and how long it took to run. A function is reported
+	// after the commands in its body.
+	Command(kind CommandKind, name string, exit int, dur time.Duration)
+}
+
+// CommandStats holds the totals kept by a MetricsCounter for a command.
+type CommandStats struct {
+	Runs     int
+	Failures int // runs with a non-zero exit status
+	Duration time.Duration
+}
+
+// CommandKey identifies a command in a MetricsCounter.
+type CommandKey struct {
+	Kind CommandKind
+	Name string
+}
+
+// MetricsCounter is a Metrics implementation that keeps totals for each
+// command in memory. Its zero value is ready to use.
+type MetricsCounter struct {
+	mu    sync.Mutex
+	stats map[CommandKey]CommandStats
+}
+
+func (m *MetricsCounter) Command(kind CommandKind, name string, exit int, dur time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stats == nil {
+		m.stats = make(map[CommandKey]CommandStats)
+	}
+	key := CommandKey{kind, name}
+	st := m.stats[key]
+	st.Runs++
+	if exit != 0 {
+		st.Failures++
+	}
+	st.Duration += dur
+	m.stats[key] = st
+}
+
+// Stats returns a copy of the totals kept so far.
+func (m *MetricsCounter) Stats() map[CommandKey]CommandStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stats := make(map[CommandKey]CommandStats, len(m.stats))
+	for key, st := range m.stats {
+		stats[key] = st
+	}
+	return stats
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WritePrometheus writes the totals kept so far in the Prometheus text
+// format, as the counters sh_command_runs_total,
+// sh_command_failures_total and sh_command_seconds_total, each with the
+// labels kind and name.
+func (m *MetricsCounter) WritePrometheus(w io.Writer) error {
+	stats := m.Stats()
+	keys := make([]CommandKey, 0, len(stats))
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Kind != keys[j].Kind {
+			return keys[i].Kind < keys[j].Kind
+		}
+		return keys[i].Name < keys[j].Name
+	})
+	bw := bufio.NewWriter(w)
+	for _, metric := range []struct {
+		name, help string
+		value      func(CommandStats) string
+	}{
+		{"sh_command_runs_total", "Number of times a command was run.", func(st CommandStats) string {
+			return strconv.Itoa(st.Runs)
+		}},
+		{"sh_command_failures_total", "Number of times a command exited with a non-zero status.", func(st CommandStats) string {
+			return strconv.Itoa(st.Failures)
+		}},
+		{"sh_command_seconds_total", "Time spent running a command.", func(st CommandStats) string {
+			return strconv.FormatFloat(st.Duration.Seconds(), 'g', -1, 64)
+		}},
+	} {
+		bw.WriteString("# HELP " + metric.name + " " + metric.help + "\n")
+		bw.WriteString("# TYPE " + metric.name + " counter\n")
+		for _, key := range keys {
+			bw.WriteString(metric.name + `{kind="` + key.Kind.String() +
+				`",name="` + labelReplacer.Replace(key.Name) + `"} ` +
+				metric.value(stats[key]) + "\n")
+		}
+	}
+	return bw.Flush()
+}
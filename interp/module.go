@@ -5,10 +5,14 @@ package interp
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 )
 
 // Ctxt is the type passed to all the module functions. It contains some
@@ -35,6 +39,10 @@ type Ctxt struct {
 // exec.LookPath(name)"?
 type ModuleExec func(ctx Ctxt, name string, args []string) error
 
+// DefaultExec runs programs as separate processes via os/exec. On
+// platforms that cannot start processes, such as js/wasm, all programs
+// are reported as not found; use CoreUtilsExec or a module of your own
+// instead.
 func DefaultExec(ctx Ctxt, name string, args []string) error {
 	cmd := exec.CommandContext(ctx.Context, name, args...)
 	cmd.Env = ctx.Env
@@ -62,6 +70,114 @@ func DefaultExec(ctx Ctxt, name string, args []string) error {
 	}
 }
 
+// CommandError describes a program that failed with a non-zero exit
+// status. It is returned by exec modules wrapped with CommandErrors.
+//
+// The interpreter treats it like its Exit code, so it does not stop the
+// program. If the program does stop because of such a failure, such as
+// when it was the last command or with "set -e", Run returns the
+// CommandError instead of the ExitCode.
+type CommandError struct {
+	Args     []string // the program name followed by its arguments
+	Path     string   // the resolved path of the program, if found
+	Dir      string
+	Duration time.Duration
+
+	// Stderr holds the last bytes that the program wrote to its
+	// standard error, up to CommandErrorStderr of them.
+	Stderr []byte
+
+	Exit ExitCode
+}
+
+// CommandErrorStderr is the number of trailing bytes of standard error
+// kept in a CommandError.
+const CommandErrorStderr = 1024
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Args[0], e.Exit)
+}
+
+// CommandErrors wraps an exec module so that failed programs result in
+// a *CommandError, giving embedders more information than an ExitCode.
+func CommandErrors(next ModuleExec) ModuleExec {
+	return func(ctx Ctxt, name string, args []string) error {
+		tail := &tailWriter{max: CommandErrorStderr}
+		ctx.Stderr = io.MultiWriter(ctx.Stderr, tail)
+		start := time.Now()
+		err := next(ctx, name, args)
+		code, ok := err.(ExitCode)
+		if !ok || code == 0 {
+			return err
+		}
+		cerr := &CommandError{
+			Args:     append([]string{name}, args...),
+			Dir:      ctx.Dir,
+			Duration: time.Since(start),
+			Stderr:   tail.buf,
+			Exit:     code,
+		}
+		cerr.Path, _ = lookPath(ctx.Env, ctx.Dir, name)
+		return cerr
+	}
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if over := len(w.buf) - w.max; over > 0 {
+		w.buf = append(w.buf[:0], w.buf[over:]...)
+	}
+	return len(p), nil
+}
+
+// lookPath is like exec.LookPath, but it uses the PATH in env and
+// resolves relative paths from dir.
+func lookPath(env []string, dir, name string) (string, error) {
+	if strings.Contains(name, "/") {
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		return path, findExecutable(path)
+	}
+	var pathList string
+	for _, kv := range env {
+		if strings.HasPrefix(kv, "PATH=") {
+			pathList = kv[len("PATH="):]
+		}
+	}
+	for _, elem := range filepath.SplitList(pathList) {
+		if elem == "" {
+			elem = "."
+		}
+		path := filepath.Join(elem, name)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		if err := findExecutable(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+}
+
+func findExecutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() || info.Mode()&0111 == 0 {
+		return os.ErrPermission
+	}
+	return nil
+}
+
 // ModuleOpen is the module responsible for opening a file. It is
 // executed for all files that are opened directly by the shell, such as
 // in redirects. Files opened by executed programs are not included.
@@ -4,11 +4,17 @@
 package interp
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"mvdan.cc/sh/syntax"
 )
@@ -117,3 +123,373 @@ func TestRunnerModules(t *testing.T) {
 		})
 	}
 }
+
+func TestRecordReplayExec(t *testing.T) {
+	src := "echo foo | sed 's/o/a/g'; sh -c 'echo bar >&2; exit 3'; echo $?"
+	want := "faa\nbar\n3\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	run := func(exec ModuleExec) string {
+		var cb concBuffer
+		r := Runner{Stdout: &cb, Stderr: &cb, Exec: exec}
+		r.Reset()
+		if err := r.Run(file); err != nil {
+			cb.WriteString(err.Error())
+		}
+		return cb.String()
+	}
+	var log bytes.Buffer
+	if got := run(RecordExec(&log, DefaultExec)); got != want {
+		t.Fatalf("wrong output when recording:\nwant: %q\ngot:  %q", want, got)
+	}
+	if n := strings.Count(log.String(), "\n"); n != 2 {
+		t.Fatalf("want 2 records, got %d:\n%s", n, log.String())
+	}
+	replay, err := ReplayExec(&log, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := run(replay); got != want {
+		t.Fatalf("wrong output when replaying:\nwant: %q\ngot:  %q", want, got)
+	}
+	wantErr := `no recorded run for ["missing"]`
+	file, _ = syntax.NewParser().Parse(strings.NewReader("missing"), "")
+	if got := run(replay); got != wantErr {
+		t.Fatalf("wrong output for missing record:\nwant: %q\ngot:  %q", wantErr, got)
+	}
+}
+
+func TestCommandErrors(t *testing.T) {
+	cases := []struct {
+		src      string
+		wantExit int // -1 if no CommandError is wanted
+		wantArgs []string
+		wantErr  string // last bytes of stderr
+	}{
+		{"sh -c 'echo oops >&2; exit 3'", 3, []string{"sh", "-c", "echo oops >&2; exit 3"}, "oops\n"},
+		{"set -e; sh -c 'exit 2'; echo unreachable", 2, []string{"sh", "-c", "exit 2"}, ""},
+		{"{ sh -c 'exit 4'; }", 4, []string{"sh", "-c", "exit 4"}, ""},
+		{"sh -c 'head -c 2000 /dev/zero | tr \"\\0\" a >&2; exit 1'", 1, nil, strings.Repeat("a", CommandErrorStderr)},
+		{"sh -c 'exit 2'; true", -1, nil, ""},
+		{"sh -c 'exit 2'; exit 5", -1, nil, ""},
+	}
+	p := syntax.NewParser()
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file, err := p.Parse(strings.NewReader(c.src), "")
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			r := Runner{
+				Stdout: ioutil.Discard,
+				Stderr: ioutil.Discard,
+				Exec:   CommandErrors(DefaultExec),
+			}
+			r.Reset()
+			err = r.Run(file)
+			cerr, ok := err.(*CommandError)
+			if c.wantExit < 0 {
+				if ok {
+					t.Fatalf("unexpected CommandError: %v", cerr)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("want a *CommandError, got %#v", err)
+			}
+			if int(cerr.Exit) != c.wantExit {
+				t.Fatalf("want exit %d, got %d", c.wantExit, cerr.Exit)
+			}
+			if c.wantArgs != nil && strings.Join(cerr.Args, "\x00") != strings.Join(c.wantArgs, "\x00") {
+				t.Fatalf("want args %q, got %q", c.wantArgs, cerr.Args)
+			}
+			if !strings.HasSuffix(cerr.Path, "/sh") {
+				t.Fatalf("want path to sh, got %q", cerr.Path)
+			}
+			if cerr.Dir != r.Dir {
+				t.Fatalf("want dir %q, got %q", r.Dir, cerr.Dir)
+			}
+			if got := string(cerr.Stderr); got != c.wantErr {
+				t.Fatalf("want stderr %q, got %q", c.wantErr, got)
+			}
+		})
+	}
+}
+
+func TestCoreUtilsExec(t *testing.T) {
+	cases := []struct {
+		src, want string
+	}{
+		{"basename /a/b.go .go; basename a/; dirname /a/b c", "b\na\n/a\n.\n"},
+		{"dirname a/ /a//", ".\n/\n"},
+		{"mkdir d; cd d; realpath . x ../d/..; realpath -e x; echo $?", "$DIR/d\n$DIR/d/x\n$DIR\nrealpath: x: no such file or directory\n1\n"},
+		{"realpath x/y; echo $?; realpath -m x/y; realpath -s /a/../b", "realpath: x/y: no such file or directory\n1\n$DIR/x/y\n/b\n"},
+		{"printf 'x\\ny\\n' >f; cat f - f <<<z", "x\ny\nz\nx\ny\n"},
+		{"cat missing; echo $?", "cat: missing: no such file or directory\n1\n"},
+		{"mkdir -p d/e; touch() { : >$1; }; touch d/f; touch .h; ls; ls -a d", "d\n.\n..\ne\nf\n"},
+		{"mkdir d; mkdir d; echo $?", "mkdir: d: file exists\n1\n"},
+		{"mkdir d; echo x >d/f; cp -r d e; cat e/f; cp d/f g; mv g e; ls e", "x\nf\ng\n"},
+		{"mkdir d; cp d e; echo $?", "cp: d: -r not specified; omitting directory\n1\n"},
+		{"mkdir d; rm d; echo $?; rm -r d; rm -f d; ls", "rm: d: is a directory\n1\n"},
+		{"rm nothere; echo $?", "rm: nothere: no such file or directory\n1\n"},
+		{"printf '1\\n2\\n3\\n4\\n' | head -n 2", "1\n2\n"},
+		{"printf '1\\n2\\n3\\n4' | head -3 | tail -n 1", "3\n"},
+		{"printf '1\\n2\\n3\\n4\\n' | tail -2", "3\n4\n"},
+		{"printf '1\\n2\\n3\\n4\\n' | tail -n +3", "3\n4\n"},
+		{"printf 'foo bar\\nbaz\\n' | wc", "      2       3      12\n"},
+		{"printf 'foo bar\\nbaz\\n' | wc -l", "2\n"},
+		{"printf 'foo bar\\nbaz\\n' >f; wc -w f", "3 f\n"},
+		{"printf 'foo\\nbar\\nFOO\\n' | grep -n o", "1:foo\n"},
+		{"printf 'foo\\nbar\\nFOO\\n' | grep -ic o", "2\n"},
+		{"printf 'foo\\nbar\\n' | grep -v 'o\\+'", "bar\n"},
+		{"printf 'foo\\nbar\\n' | grep -E 'a|x'", "bar\n"},
+		{"printf 'a.b\\n' | grep -F .; grep -q x <<<y; echo $?", "a.b\n1\n"},
+		{"echo x >f; echo y >g; grep -l y f g; grep y f g", "g\ng:y\n"},
+		{"grep x missing; echo $?", "grep: missing: no such file or directory\n2\n"},
+		{"echo foo | sed 's/o/a/g'", "faa\n"},
+		{"echo foo | sed -e 's/\\(f\\)\\(o\\)/\\2\\1&/'", "offoo\n"},
+		{"echo a/b | sed 's,/,[&],'", "a[/]b\n"},
+		{"printf '1\\n2\\n3\\n' | sed -n '2p;$p'", "2\n3\n"},
+		{"printf '1\\n2\\n3\\n' | sed '/2/d'", "1\n3\n"},
+		{"printf '1\\n2\\n3\\n' | sed 2q", "1\n2\n"},
+		{"printf 'ab\\nb' | sed -E 's/(a)?b/x\\1/'", "xa\nx"},
+		{"echo x | sed k; echo $?", "sed: -e expression: unknown command: `k'\n1\n"},
+		{"sleep 0.01s; echo done", "done\n"},
+		{"foo_bar_missing; echo $?", "foo_bar_missing: command not found\n127\n"},
+	}
+	p := syntax.NewParser()
+	for i, c := range cases {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "interp-coreutils")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			file, err := p.Parse(strings.NewReader(c.src), "")
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			var cb concBuffer
+			r := Runner{
+				Dir:    dir,
+				Stdout: &cb,
+				Stderr: &cb,
+				Exec:   CoreUtilsExec(nil),
+			}
+			r.Reset()
+			if err := r.Run(file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			realDir, err := filepath.EvalSymlinks(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Replace(c.want, "$DIR", realDir, -1)
+			if got := cb.String(); got != want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					c.src, want, got)
+			}
+		})
+	}
+}
+
+func TestPathUtilsExec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interp-pathutils")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "dirname"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := "basename /a/b; dirname /a/b; realpath -s /a/../b; cat x"
+	want := "b\nnext: dirname [/a/b]\n/b\nnext: cat [x]\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	var cb concBuffer
+	r := Runner{
+		Env:    []string{"PATH=" + dir},
+		Stdout: &cb,
+		Stderr: &cb,
+		Exec: PathUtilsExec(func(ctx Ctxt, name string, args []string) error {
+			fmt.Fprintf(ctx.Stdout, "next: %s %v\n", name, args)
+			return nil
+		}),
+	}
+	r.Reset()
+	if err := r.Run(file); err != nil {
+		cb.WriteString(err.Error())
+	}
+	if got := cb.String(); got != want {
+		t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", src, want, got)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	src := "echo foo >f; sh -c 'cat; echo bar >&2' <f; FOO=x sh -c 'exit 3'; cat <missing"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "interp-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var log bytes.Buffer
+	audit := NewAuditLog(&log, []string{"PATH=" + os.Getenv("PATH"), "SHLVL=1", "BAR=y"})
+	var cb concBuffer
+	r := Runner{
+		Dir:    dir,
+		Env:    []string{"PATH=" + os.Getenv("PATH")},
+		Stdout: &cb,
+		Stderr: &cb,
+		Exec:   audit.Exec(DefaultExec),
+		Open:   audit.Open(DefaultOpen),
+	}
+	r.Reset()
+	if err := r.Run(file); err != nil {
+		cb.WriteString(err.Error())
+	}
+	var events []AuditEvent
+	dec := json.NewDecoder(&log)
+	for {
+		var ev AuditEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if ev.Time.IsZero() || ev.Dir != dir {
+			t.Fatalf("missing time or dir in event: %#v", ev)
+		}
+		ev.Time, ev.Dir, ev.Duration = time.Time{}, "", 0
+		events = append(events, ev)
+	}
+	want := []AuditEvent{
+		{Op: "open", Path: filepath.Join(dir, "f"), Flag: os.O_RDWR | os.O_CREATE | os.O_TRUNC, Written: 4},
+		{Op: "exec", Args: []string{"sh", "-c", "cat; echo bar >&2"}, EnvUnset: []string{"BAR"}, Stdout: 4, Stderr: 4},
+		{Op: "open", Path: filepath.Join(dir, "f"), Flag: os.O_RDONLY, Read: 4},
+		{Op: "exec", Args: []string{"sh", "-c", "exit 3"}, EnvSet: map[string]string{"FOO": "x"}, EnvUnset: []string{"BAR"}, Exit: 3},
+		{Op: "open", Path: filepath.Join(dir, "missing"), Flag: os.O_RDONLY, Error: "open " + filepath.Join(dir, "missing") + ": no such file or directory"},
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("wrong events:\nwant: %+v\ngot:  %+v", want, events)
+	}
+}
+
+func TestMetricsCounter(t *testing.T) {
+	src := `f() { echo a; false; }; f; f; true | sh -c 'exit 2'; cd "a\"b"`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatalf("could not parse: %v", err)
+	}
+	var m MetricsCounter
+	r := Runner{Stdout: ioutil.Discard, Stderr: ioutil.Discard, Metrics: &m}
+	r.Reset()
+	r.Run(file)
+	want := map[CommandKey]CommandStats{
+		{BuiltinCommand, "echo"}:  {Runs: 2},
+		{BuiltinCommand, "false"}: {Runs: 2, Failures: 2},
+		{BuiltinCommand, "true"}:  {Runs: 1},
+		{BuiltinCommand, "cd"}:    {Runs: 1, Failures: 1},
+		{FuncCommand, "f"}:        {Runs: 2, Failures: 2},
+		{ProgramCommand, "sh"}:    {Runs: 1, Failures: 1},
+	}
+	got := m.Stats()
+	for key, st := range got {
+		if st.Duration <= 0 {
+			t.Errorf("non-positive duration for %v", key)
+		}
+		st.Duration = 0
+		got[key] = st
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong stats:\nwant: %v\ngot:  %v", want, got)
+	}
+	var buf bytes.Buffer
+	if err := m.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE sh_command_runs_total counter\n",
+		`sh_command_runs_total{kind="builtin",name="cd"} 1` + "\n",
+		`sh_command_failures_total{kind="func",name="f"} 2` + "\n",
+		`sh_command_failures_total{kind="program",name="sh"} 1` + "\n",
+		`sh_command_seconds_total{kind="builtin",name="false"} `,
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("output does not contain %q:\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestEffects(t *testing.T) {
+	src := `
+f() { rm -rf "$1"; }
+f /tmp/x
+echo foo >out.txt 2>/dev/null
+cat <in.txt >>"log $n"; command grep 'a b'
+command -v curl || curl -s https://example.com
+$prog arg
+eval "$code"
+exec 3>/dev/tcp/host/80
+`
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(effs []Effect) []string {
+		var list []string
+		for _, eff := range effs {
+			s := eff.Name
+			if eff.Dynamic {
+				s = "?" + s
+			}
+			if len(eff.Args) > 0 {
+				s += " " + strings.Join(eff.Args, " ")
+			}
+			list = append(list, s)
+		}
+		return list
+	}
+	e := AnalyzeEffects(file)
+	got := [][]string{names(e.Commands), names(e.Writes), names(e.Reads), names(e.Network)}
+	want := [][]string{
+		{"rm -rf \"$1\"", "cat", "grep a b", "curl -s https://example.com", "?$prog arg", "eval \"$code\""},
+		{"out.txt", "?\"log $n\"", "/dev/tcp/host/80"},
+		{"in.txt"},
+		{"curl -s https://example.com", "/dev/tcp/host/80"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong static effects:\nwant: %q\ngot:  %q", want, got)
+	}
+
+	e = &Effects{}
+	r := Runner{
+		Env:    []string{"prog=wget", "code=ls"},
+		Dir:    "/dir",
+		Stdout: ioutil.Discard,
+		Stderr: ioutil.Discard,
+		Exec:   e.Exec,
+		Open:   e.Open,
+	}
+	r.Reset()
+	if err := r.Run(file); err != nil {
+		t.Fatal(err)
+	}
+	got = [][]string{names(e.Commands), names(e.Writes), names(e.Reads), names(e.Network)}
+	want = [][]string{
+		{"rm -rf /tmp/x", "cat", "grep a b", "curl -s https://example.com", "wget arg", "ls"},
+		{"/dir/out.txt", "/dir/log ", "/dev/tcp/host/80"},
+		{"/dir/in.txt"},
+		{"curl -s https://example.com", "wget arg", "/dev/tcp/host/80"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("wrong dry-run effects:\nwant: %q\ngot:  %q", want, got)
+	}
+}
@@ -4,6 +4,8 @@
 package interp
 
 import (
+	"bytes"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode"
@@ -12,27 +14,36 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
-func (r *Runner) quotedElems(pe *syntax.ParamExp) []string {
-	if pe == nil {
-		return nil
+// quotedElems returns the elements that "$@" or "${a[@]}" expand to,
+// each as a separate field. If pe is neither, ok is false.
+func (r *Runner) quotedElems(pe *syntax.ParamExp) (elems []string, ok bool) {
+	if pe.Excl || pe.Length || pe.Slice != nil || pe.Repl != nil || pe.Exp != nil {
+		return nil, false
 	}
 	if pe.Param.Value == "@" {
-		return r.Params
+		return r.Params, true
 	}
 	w, _ := pe.Index.(*syntax.Word)
 	if w == nil || len(w.Parts) != 1 {
-		return nil
+		return nil, false
 	}
 	l, _ := w.Parts[0].(*syntax.Lit)
 	if l == nil || l.Value != "@" {
-		return nil
+		return nil, false
 	}
 	val, _ := r.lookupVar(pe.Param.Value)
 	switch x := val.(type) {
 	case []string:
-		return x
+		return x, true
+	case arrayMap:
+		for _, key := range x.keys {
+			elems = append(elems, x.vals[key])
+		}
+		return elems, true
+	case nil:
+		return nil, true
 	}
-	return nil
+	return []string{r.varStr(val, 0)}, true
 }
 
 func (r *Runner) paramExp(pe *syntax.ParamExp) string {
@@ -89,16 +100,28 @@ func (r *Runner) paramExp(pe *syntax.ParamExp) string {
 		}
 	}
 	if pe.Repl != nil {
-		orig := r.loneWord(pe.Repl.Orig)
-		with := r.loneWord(pe.Repl.With)
-		n := 1
-		if pe.Repl.All {
-			n = -1
+		orig := r.pattern(pe.Repl.Orig)
+		anchor := byte(0)
+		if w := pe.Repl.Orig; w != nil {
+			// only an unquoted # or % at the start anchors
+			if lit, ok := w.Parts[0].(*syntax.Lit); ok && lit.Value != "" {
+				if c := lit.Value[0]; c == '#' || c == '%' {
+					anchor, orig = c, orig[1:]
+				}
+			}
 		}
-		str = strings.Replace(str, orig, with, n)
+		with := r.loneWord(pe.Repl.With)
+		str = replacePattern(str, orig, with, anchor, pe.Repl.All)
 	}
 	if pe.Exp != nil {
-		arg := r.loneWord(pe.Exp.Word)
+		var arg string
+		switch pe.Exp.Op {
+		case syntax.RemSmallPrefix, syntax.RemLargePrefix,
+			syntax.RemSmallSuffix, syntax.RemLargeSuffix:
+			arg = r.pattern(pe.Exp.Word)
+		default:
+			arg = r.loneWord(pe.Exp.Word)
+		}
 		switch pe.Exp.Op {
 		case syntax.SubstColPlus:
 			if str == "" {
@@ -186,8 +209,45 @@ func (r *Runner) paramExp(pe *syntax.ParamExp) string {
 	return str
 }
 
+// replacePattern replaces the longest match of a pattern in str, or all
+// of its matches if all is set. The match must be at the start of str
+// if anchor is '#', or at its end if anchor is '%'. Empty matches are
+// only replaced when anchored, to prepend or append to str.
+func replacePattern(str, pattern, with string, anchor byte, all bool) string {
+	expr := patternExpr(pattern, patMatch)
+	switch anchor {
+	case '#':
+		expr = "^(?:" + expr + ")"
+	case '%':
+		expr = "(?:" + expr + ")$"
+	}
+	rx, err := regexp.Compile("(?s)" + expr)
+	if err != nil {
+		return str
+	}
+	rx.Longest()
+	var buf bytes.Buffer
+	last := 0
+	for _, loc := range rx.FindAllStringIndex(str, -1) {
+		if loc[0] == loc[1] && anchor == 0 {
+			continue
+		}
+		buf.WriteString(str[last:loc[0]])
+		buf.WriteString(with)
+		last = loc[1]
+		if !all {
+			break
+		}
+	}
+	buf.WriteString(str[last:])
+	return buf.String()
+}
+
 func removePattern(str, pattern string, fromEnd, longest bool) string {
-	// TODO: really slow to not re-implement path.Match.
+	rx, err := patternRegexp(pattern, patMatch)
+	if err != nil {
+		return str
+	}
 	last := str
 	s := str
 	i := len(str)
@@ -195,7 +255,7 @@ func removePattern(str, pattern string, fromEnd, longest bool) string {
 		i = 0
 	}
 	for {
-		if match(pattern, s) {
+		if rx.MatchString(s) {
 			last = str[i:]
 			if fromEnd {
 				last = str[:i]
@@ -0,0 +1,240 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// patternMode selects the rules used to match a shell pattern.
+type patternMode uint
+
+const (
+	// patMatch is used for pattern matching, such as in case
+	// clauses, [[ and parameter expansions. Wildcards match any
+	// character, and the filesystem is never involved.
+	patMatch patternMode = iota
+
+	// patFilenames is used for filename expansion, where wildcards
+	// never match a slash.
+	patFilenames
+)
+
+// patternRegexp translates a shell pattern into an anchored regular
+// expression. Backslashes escape the character that follows them.
+func patternRegexp(pat string, mode patternMode) (*regexp.Regexp, error) {
+	return regexp.Compile("(?s)^" + patternExpr(pat, mode) + "$")
+}
+
+// patternExpr translates a shell pattern into the source of an
+// unanchored regular expression, like patternRegexp.
+func patternExpr(pat string, mode patternMode) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(pat); i++ {
+		switch c := pat[i]; c {
+		case '*':
+			if mode == patFilenames {
+				buf.WriteString("[^/]*")
+			} else {
+				buf.WriteString(".*")
+			}
+		case '?':
+			if mode == patFilenames {
+				buf.WriteString("[^/]")
+			} else {
+				buf.WriteString(".")
+			}
+		case '\\':
+			if i++; i < len(pat) {
+				buf.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+			} else {
+				buf.WriteString(`\\`)
+			}
+		case '[':
+			end := bracketEnd(pat, i)
+			if end < 0 {
+				// not a bracket expression
+				buf.WriteString(`\[`)
+				break
+			}
+			writeBracket(&buf, pat[i+1:end])
+			i = end
+		default:
+			buf.WriteString(regexp.QuoteMeta(pat[i : i+1]))
+		}
+	}
+	return buf.String()
+}
+
+// bracketEnd returns the index of the ']' closing the bracket
+// expression starting at pat[start], or -1 if there is none.
+func bracketEnd(pat string, start int) int {
+	i := start + 1
+	if i < len(pat) && (pat[i] == '!' || pat[i] == '^') {
+		i++
+	}
+	if i < len(pat) && pat[i] == ']' {
+		i++ // a leading ']' is taken literally
+	}
+	for ; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+		case '[':
+			if i+1 < len(pat) && pat[i+1] == ':' {
+				if j := strings.Index(pat[i+2:], ":]"); j >= 0 {
+					i += j + 3
+				}
+			}
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// writeBracket writes the contents of a bracket expression, without
+// the enclosing brackets, as a regular expression character class.
+func writeBracket(buf *bytes.Buffer, s string) {
+	buf.WriteByte('[')
+	if s[0] == '!' || s[0] == '^' {
+		buf.WriteByte('^')
+		s = s[1:]
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '[' && strings.HasPrefix(s[i:], "[:"):
+			if j := strings.Index(s[i+2:], ":]"); j >= 0 {
+				buf.WriteString(s[i : i+j+4])
+				i += j + 3
+				continue
+			}
+		case c == '\\' && i+1 < len(s):
+			i++
+			c = s[i]
+		}
+		if c != '-' && c < 0x80 && strings.IndexByte(`\[]^$.|?*+(){}`, c) >= 0 {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(c)
+	}
+	buf.WriteByte(']')
+}
+
+// match reports whether name matches a shell pattern, following the
+// rules for pattern matching. An invalid pattern, such as one with a
+// bad character class, matches nothing.
+func match(pat, name string) bool {
+	rx, err := patternRegexp(pat, patMatch)
+	return err == nil && rx.MatchString(name)
+}
+
+// hasGlob reports whether a pattern contains any unescaped wildcards.
+func hasGlob(pat string) bool {
+	for i := 0; i < len(pat); i++ {
+		switch pat[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapePattern removes the backslashes escaping characters in a
+// pattern without wildcards.
+func unescapePattern(pat string) string {
+	if strings.IndexByte(pat, '\\') < 0 {
+		return pat
+	}
+	var buf bytes.Buffer
+	for i := 0; i < len(pat); i++ {
+		if pat[i] == '\\' && i+1 < len(pat) {
+			i++
+		}
+		buf.WriteByte(pat[i])
+	}
+	return buf.String()
+}
+
+// glob performs filename expansion, returning the sorted paths of the
+// files matching a pattern. Relative patterns are matched against the
+// Runner's directory, and the paths returned are relative too.
+func (r *Runner) glob(pat string) []string {
+	var matches []string
+	if strings.HasPrefix(pat, "/") {
+		matches = []string{"/"}
+		pat = pat[1:]
+	} else {
+		matches = []string{""}
+	}
+	for _, part := range strings.Split(pat, "/") {
+		var next []string
+		if !hasGlob(part) {
+			part = unescapePattern(part)
+			for _, m := range matches {
+				next = append(next, globJoin(m, part))
+			}
+			matches = next
+			continue
+		}
+		rx, err := patternRegexp(part, patFilenames)
+		if err != nil {
+			return nil
+		}
+		// a leading dot must be matched explicitly
+		dotOK := strings.HasPrefix(part, ".") || strings.HasPrefix(part, `\.`)
+		for _, m := range matches {
+			dir := m
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(r.Dir, dir)
+			}
+			f, err := os.Open(dir)
+			if err != nil {
+				continue
+			}
+			names, _ := f.Readdirnames(-1)
+			f.Close()
+			sort.Strings(names)
+			for _, name := range names {
+				if (dotOK || name[0] != '.') && rx.MatchString(name) {
+					next = append(next, globJoin(m, name))
+				}
+			}
+		}
+		matches = next
+	}
+	// components without wildcards were not checked
+	existing := matches[:0]
+	for _, m := range matches {
+		path := m
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(r.Dir, path)
+		}
+		if strings.HasSuffix(m, "/") {
+			path += "/" // must be a directory
+		}
+		if _, err := os.Lstat(path); err == nil {
+			existing = append(existing, m)
+		}
+	}
+	return existing
+}
+
+func globJoin(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	if strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ExecRecord is a single program run, as recorded by RecordExec.
+type ExecRecord struct {
+	Args    []string // the program name followed by its arguments
+	Dir     string
+	EnvHash string
+	Stdout  []byte
+	Stderr  []byte
+	Exit    int
+}
+
+func (e *ExecRecord) key() string {
+	return strings.Join(e.Args, "\x00") + "\x00" + e.Dir + "\x00" + e.EnvHash
+}
+
+// envHash returns a hash of the environment that does not depend on
+// the order of its elements.
+func envHash(env []string) string {
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, kv := range sorted {
+		io.WriteString(h, kv)
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// RecordExec wraps an exec module, writing an ExecRecord for each
+// program run to w as a line of JSON. The output of the program is
+// still written to the original standard output and error.
+//
+// Programs that fail with an error other than ExitCode are not
+// recorded. Standard input is not recorded either, so programs whose
+// output depends on it cannot be replayed faithfully.
+func RecordExec(w io.Writer, next ModuleExec) ModuleExec {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(ctx Ctxt, name string, args []string) error {
+		var outBuf, errBuf bytes.Buffer
+		rec := ExecRecord{
+			Args:    append([]string{name}, args...),
+			Dir:     ctx.Dir,
+			EnvHash: envHash(ctx.Env),
+		}
+		ctx.Stdout = io.MultiWriter(ctx.Stdout, &outBuf)
+		ctx.Stderr = io.MultiWriter(ctx.Stderr, &errBuf)
+		err := next(ctx, name, args)
+		switch x := err.(type) {
+		case nil:
+		case ExitCode:
+			rec.Exit = int(x)
+		default:
+			return err
+		}
+		rec.Stdout, rec.Stderr = outBuf.Bytes(), errBuf.Bytes()
+		mu.Lock()
+		encErr := enc.Encode(rec)
+		mu.Unlock()
+		if encErr != nil {
+			return encErr
+		}
+		return err
+	}
+}
+
+// ReplayExec reads a log written by RecordExec and returns an exec
+// module that serves program runs from it, writing the recorded output
+// and returning the recorded exit status instead of running anything.
+//
+// A run matches a record if the arguments, directory and environment
+// are the same. If the same run was recorded multiple times, the
+// records are used in order, and the last one is reused once they run
+// out. Runs without a matching record are passed on to next, or result
+// in an error if next is nil.
+func ReplayExec(r io.Reader, next ModuleExec) (ModuleExec, error) {
+	records := make(map[string][]ExecRecord)
+	dec := json.NewDecoder(r)
+	for {
+		var rec ExecRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		key := rec.key()
+		records[key] = append(records[key], rec)
+	}
+	var mu sync.Mutex
+	return func(ctx Ctxt, name string, args []string) error {
+		key := (&ExecRecord{
+			Args:    append([]string{name}, args...),
+			Dir:     ctx.Dir,
+			EnvHash: envHash(ctx.Env),
+		}).key()
+		mu.Lock()
+		recs := records[key]
+		if len(recs) == 0 {
+			mu.Unlock()
+			if next == nil {
+				return fmt.Errorf("no recorded run for %q", append([]string{name}, args...))
+			}
+			return next(ctx, name, args)
+		}
+		rec := recs[0]
+		if len(recs) > 1 {
+			records[key] = recs[1:]
+		}
+		mu.Unlock()
+		ctx.Stdout.Write(rec.Stdout)
+		ctx.Stderr.Write(rec.Stderr)
+		if rec.Exit != 0 {
+			return ExitCode(rec.Exit)
+		}
+		return nil
+	}, nil
+}
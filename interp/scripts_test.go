@@ -0,0 +1,249 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// stubExec returns a ModuleExec that only runs the given stubs. Any
+// other program is reported as not found, so that the scripts below
+// never depend on the host system.
+func stubExec(stubs map[string]func(Ctxt, []string) error) ModuleExec {
+	return func(ctx Ctxt, name string, args []string) error {
+		if fn := stubs[name]; fn != nil {
+			return fn(ctx, args)
+		}
+		fmt.Fprintf(ctx.Stderr, "%s: command not found\n", name)
+		return ExitCode(127)
+	}
+}
+
+func stubOutput(out string, code int) func(Ctxt, []string) error {
+	return func(ctx Ctxt, args []string) error {
+		fmt.Fprint(ctx.Stdout, out)
+		if code != 0 {
+			return ExitCode(code)
+		}
+		return nil
+	}
+}
+
+// scriptCases is a corpus of simplified real-world scripts. They are
+// meant to exercise many features at once, guarding against
+// regressions that the smaller test cases might not catch.
+var scriptCases = []struct {
+	name   string
+	stubs  map[string]func(Ctxt, []string) error
+	params []string
+	src    string
+	want   string
+}{
+	{
+		name: "NvmVersionCompare",
+		src: `
+nvm_strip() {
+	v=${1#v}
+	echo $v
+}
+nvm_major() {
+	v=$(nvm_strip $1)
+	echo ${v%%.*}
+}
+nvm_is_newer() {
+	a=$(nvm_major $1)
+	b=$(nvm_major $2)
+	[ $a -gt $b ]
+}
+for v in v4.8.4 v6.11.3 v8.9.0; do
+	if nvm_is_newer $v v5.0.0; then
+		echo "$v is newer"
+	else
+		echo "$v is older"
+	fi
+done
+`,
+		want: "v4.8.4 is older\nv6.11.3 is newer\nv8.9.0 is newer\n",
+	},
+	{
+		name: "NvmAliases",
+		src: `
+declare -A aliases=([stable]=8.9.0 [lts]=6.11.3)
+nvm_resolve() {
+	case "$1" in
+	stable | lts)
+		echo ${aliases["$1"]}
+		;;
+	v*)
+		echo ${1#v}
+		;;
+	*)
+		echo "unknown: $1" >&2
+		return 3
+		;;
+	esac
+}
+nvm_resolve stable
+nvm_resolve v4.0.0
+nvm_resolve foo 2>/dev/null
+echo $?
+`,
+		want: "8.9.0\n4.0.0\n3\n",
+	},
+	{
+		name: "RbenvInit",
+		src: `
+RBENV_ROOT=${RBENV_ROOT:-$HOME/.rbenv}
+rbenv_init() {
+	case "$1" in
+	bash) profile=.bashrc ;;
+	zsh) profile=.zshrc ;;
+	*) profile=.profile ;;
+	esac
+	echo 'export PATH="'$RBENV_ROOT'/shims:${PATH}"'
+	echo "# add the line above to ~/$profile"
+}
+rbenv_init bash
+rbenv_init fish
+`,
+		want: "export PATH=\"/home/user/.rbenv/shims:${PATH}\"\n# add the line above to ~/.bashrc\n" +
+			"export PATH=\"/home/user/.rbenv/shims:${PATH}\"\n# add the line above to ~/.profile\n",
+	},
+	{
+		name: "RbenvVersionFile",
+		stubs: map[string]func(Ctxt, []string) error{
+			"cat": stubOutput("2.4.2\n", 0),
+		},
+		src: `
+rbenv_version() {
+	if [ -n "$RBENV_VERSION" ]; then
+		echo "$RBENV_VERSION (set by RBENV_VERSION)"
+		return
+	fi
+	version=$(cat .ruby-version)
+	echo "$version (set by .ruby-version)"
+}
+rbenv_version
+RBENV_VERSION=2.3.0 rbenv_version
+`,
+		want: "2.4.2 (set by .ruby-version)\n2.3.0 (set by RBENV_VERSION)\n",
+	},
+	{
+		name: "ConfigurePlatform",
+		stubs: map[string]func(Ctxt, []string) error{
+			"uname": func(ctx Ctxt, args []string) error {
+				switch strings.Join(args, " ") {
+				case "-s":
+					fmt.Fprintln(ctx.Stdout, "Linux")
+				case "-m":
+					fmt.Fprintln(ctx.Stdout, "x86_64")
+				default:
+					return ExitCode(1)
+				}
+				return nil
+			},
+		},
+		src: `
+os=$(uname -s)
+arch=$(uname -m)
+case "$os-$arch" in
+Linux-x86_64) target=linux-amd64 ;;
+Darwin-*) target=darwin-amd64 ;;
+*) target=unknown ;;
+esac
+echo "checking build system type... $target"
+`,
+		want: "checking build system type... linux-amd64\n",
+	},
+	{
+		name: "ConfigureCompilerChecks",
+		stubs: map[string]func(Ctxt, []string) error{
+			"cc": func(ctx Ctxt, args []string) error {
+				for _, arg := range args {
+					if arg == "-lz" {
+						return nil
+					}
+				}
+				return ExitCode(1)
+			},
+		},
+		src: `
+found=
+check_lib() {
+	printf "checking for -l%s... " $1
+	if cc -o conftest conftest.c -l$1 2>/dev/null; then
+		echo yes
+		found="$found $1"
+	else
+		echo no
+	fi
+}
+check_lib z
+check_lib ssl
+echo "found:$found"
+`,
+		want: "checking for -lz... yes\nchecking for -lssl... no\nfound: z\n",
+	},
+	{
+		name: "ConfigureMissingTool",
+		src: `
+if ! pkg-config --exists libfoo; then
+	echo "libfoo not found" >&2
+	exit 1
+fi
+echo unreachable
+`,
+		want: "pkg-config: command not found\nlibfoo not found\nexit status 1",
+	},
+	{
+		name:   "ArgumentParsing",
+		params: []string{"-v", "a", "-v", "b", "--", "c"},
+		src: `
+verbose=0
+files=
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-v) verbose=$((verbose + 1)) ;;
+	--) shift; break ;;
+	-*) echo "bad flag: $1"; exit 2 ;;
+	*) files="$files $1" ;;
+	esac
+	shift
+done
+echo "verbose=$verbose files=$files rest=$@"
+`,
+		want: "verbose=2 files= a b rest=c\n",
+	},
+}
+
+func TestScripts(t *testing.T) {
+	p := syntax.NewParser()
+	for _, tc := range scriptCases {
+		t.Run(tc.name, func(t *testing.T) {
+			file, err := p.Parse(strings.NewReader(tc.src), "")
+			if err != nil {
+				t.Fatalf("could not parse: %v", err)
+			}
+			var cb concBuffer
+			r := Runner{
+				Env:    []string{"HOME=/home/user"},
+				Stdout: &cb,
+				Stderr: &cb,
+				Params: tc.params,
+				Exec:   stubExec(tc.stubs),
+			}
+			r.Reset()
+			if err := r.Run(file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != tc.want {
+				t.Fatalf("wrong output:\nwant: %q\ngot:  %q", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"mvdan.cc/sh/syntax"
+)
+
+// Snapshot holds the state of a Runner, so that it may be saved and
+// later restored to continue running a program. All of its fields are
+// exported and of basic types, so it can be encoded with packages like
+// encoding/json or encoding/gob.
+//
+// A snapshot does not include the Runner's exported configuration
+// fields such as Env, Stdin or the modules, which must be set again
+// before calling Restore. Neither does it include any state that only
+// exists while a statement is running, such as background jobs, open
+// redirections or variables local to a single command.
+type Snapshot struct {
+	Vars     map[string]VarSnapshot
+	Funcs    map[string]string // function bodies, as shell source
+	Dir      string
+	DirStack []string
+	Params   []string
+	Opts     []string // as accepted by Runner.FromArgs
+	Exit     int
+
+	// Stmt is the index of the next top-level statement to run in
+	// the File that was being run. Running the same File after
+	// Restore will resume from this statement.
+	Stmt int
+}
+
+// VarSnapshot holds the value of a single variable in a Snapshot.
+type VarSnapshot struct {
+	// Kind is one of "string", "indexed", "assoc", "nameref" or
+	// "unset", the latter meaning declared but without a value.
+	Kind string
+
+	Exported bool `json:",omitempty"`
+	ReadOnly bool `json:",omitempty"`
+
+	Value string            `json:",omitempty"` // string, nameref
+	List  []string          `json:",omitempty"` // indexed
+	Keys  []string          `json:",omitempty"` // assoc, in order
+	Map   map[string]string `json:",omitempty"` // assoc
+}
+
+// Snapshot returns the current state of the Runner. It is meant to be
+// called between statements, for example from a module or once Run
+// has returned after the Context was cancelled. If called while a
+// top-level statement is running, resuming from the snapshot will run
+// the rest of that statement again from its start.
+func (r *Runner) Snapshot() (*Snapshot, error) {
+	s := &Snapshot{
+		Vars:     make(map[string]VarSnapshot, len(r.vars)),
+		Funcs:    make(map[string]string, len(r.funcs)),
+		Dir:      r.Dir,
+		DirStack: append([]string(nil), r.dirStack...),
+		Params:   append([]string(nil), r.Params...),
+		Opts:     r.optFlags(),
+		Exit:     r.exit,
+		Stmt:     r.stmtIndex,
+	}
+	for name, vr := range r.vars {
+		var vs VarSnapshot
+		switch x := vr.value.(type) {
+		case string:
+			vs = VarSnapshot{Kind: "string", Value: x}
+		case []string:
+			vs = VarSnapshot{Kind: "indexed", List: append([]string(nil), x...)}
+		case arrayMap:
+			vs = VarSnapshot{Kind: "assoc", Keys: append([]string(nil), x.keys...)}
+			vs.Map = make(map[string]string, len(x.vals))
+			for k, v := range x.vals {
+				vs.Map[k] = v
+			}
+		case nameRef:
+			vs = VarSnapshot{Kind: "nameref", Value: string(x)}
+		case nil:
+			vs = VarSnapshot{Kind: "unset"}
+		default:
+			return nil, fmt.Errorf("cannot snapshot variable %q of type %T", name, x)
+		}
+		vs.Exported, vs.ReadOnly = vr.exported, vr.readOnly
+		s.Vars[name] = vs
+	}
+	printer := syntax.NewPrinter()
+	var buf bytes.Buffer
+	for name, body := range r.funcs {
+		buf.Reset()
+		f := &syntax.File{StmtList: syntax.StmtList{
+			Stmts: []*syntax.Stmt{body},
+		}}
+		if err := printer.Print(&buf, f); err != nil {
+			return nil, err
+		}
+		s.Funcs[name] = buf.String()
+	}
+	return s, nil
+}
+
+// Restore sets the state of the Runner to the one held by a snapshot.
+// Reset must have been called before, and the Runner must not be
+// running.
+//
+// Function bodies are parsed again, so positions in their nodes and in
+// any errors will refer to the snapshot's source and not to the
+// original program.
+func (r *Runner) Restore(s *Snapshot) error {
+	if _, err := r.FromArgs(s.Opts...); err != nil {
+		return err
+	}
+	for name, vs := range s.Vars {
+		vr := variable{exported: vs.Exported, readOnly: vs.ReadOnly}
+		switch vs.Kind {
+		case "string":
+			vr.value = vs.Value
+		case "indexed":
+			vr.value = append([]string(nil), vs.List...)
+		case "assoc":
+			amap := arrayMap{
+				keys: append([]string(nil), vs.Keys...),
+				vals: make(map[string]string, len(vs.Map)),
+			}
+			for k, v := range vs.Map {
+				amap.vals[k] = v
+			}
+			vr.value = amap
+		case "nameref":
+			vr.value = nameRef(vs.Value)
+		case "unset":
+		default:
+			return fmt.Errorf("invalid kind for variable %q: %q", name, vs.Kind)
+		}
+		r.vars[name] = vr
+	}
+	p := syntax.NewParser()
+	for name, src := range s.Funcs {
+		f, err := p.Parse(strings.NewReader(src), "")
+		if err != nil {
+			return fmt.Errorf("invalid body for func %q: %v", name, err)
+		}
+		if len(f.Stmts) != 1 {
+			return fmt.Errorf("invalid body for func %q: want one statement", name)
+		}
+		r.setFunc(name, f.Stmts[0])
+	}
+	if s.Dir != "" {
+		r.Dir = s.Dir
+	}
+	if len(s.DirStack) > 0 {
+		r.dirStack = append([]string(nil), s.DirStack...)
+	}
+	r.Params = append([]string(nil), s.Params...)
+	r.exit = s.Exit
+	r.resumeAt = s.Stmt
+	return nil
+}
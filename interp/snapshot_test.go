@@ -0,0 +1,101 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/syntax"
+)
+
+var errCheckpoint = fmt.Errorf("checkpoint")
+
+func TestSnapshotRestore(t *testing.T) {
+	src := `
+set -e
+a=foo
+arr=(x y z)
+declare -A m=([k]=v)
+declare -n ref=a
+f() { echo "f: $@ $a"; }
+set -- p1 p2
+checkpoint
+f $1
+echo ${arr[2]} ${m["k"]} $ref $# $?
+`
+	want := "f: p1 foo\nz v foo 2 0\n"
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodings := []struct {
+		name      string
+		roundTrip func(*Snapshot) (*Snapshot, error)
+	}{
+		{"JSON", func(s *Snapshot) (*Snapshot, error) {
+			bs, err := json.Marshal(s)
+			if err != nil {
+				return nil, err
+			}
+			s2 := new(Snapshot)
+			return s2, json.Unmarshal(bs, s2)
+		}},
+		{"Gob", func(s *Snapshot) (*Snapshot, error) {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+				return nil, err
+			}
+			s2 := new(Snapshot)
+			return s2, gob.NewDecoder(&buf).Decode(s2)
+		}},
+	}
+	for _, enc := range encodings {
+		t.Run(enc.name, func(t *testing.T) {
+			var snap *Snapshot
+			var cb concBuffer
+			r := &Runner{Stdout: &cb, Stderr: &cb}
+			r.Exec = func(ctx Ctxt, name string, args []string) error {
+				if name != "checkpoint" {
+					return DefaultExec(ctx, name, args)
+				}
+				if snap != nil {
+					return nil
+				}
+				var err error
+				if snap, err = r.Snapshot(); err != nil {
+					return err
+				}
+				return errCheckpoint
+			}
+			r.Reset()
+			if err := r.Run(file); err != errCheckpoint {
+				t.Fatalf("want checkpoint error, got: %v", err)
+			}
+			if got := cb.String(); got != "" {
+				t.Fatalf("unexpected output before checkpoint: %q", got)
+			}
+			snap2, err := enc.roundTrip(snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r2 := &Runner{Stdout: &cb, Stderr: &cb, Exec: r.Exec}
+			r2.Reset()
+			if err := r2.Restore(snap2); err != nil {
+				t.Fatal(err)
+			}
+			if err := r2.Run(file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != want {
+				t.Fatalf("wrong output after restore:\nwant: %q\ngot:  %q",
+					want, got)
+			}
+		})
+	}
+}
@@ -4,9 +4,9 @@
 package interp
 
 import (
-	"bytes"
+	"fmt"
+	"io"
 	"os"
-	"os/exec"
 	"regexp"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -14,6 +14,56 @@ import (
 	"mvdan.cc/sh/syntax"
 )
 
+// StatFS is a filesystem that file tests such as -f can query, used by
+// EvalTest. The paths it is given are absolute and have been cleaned.
+type StatFS interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+}
+
+// EvalTest evaluates a test expression, such as one parsed with
+// syntax.Parser.Test, following the same rules as the interpreter does
+// for [[ expr ]]. It does not need a program to be run, so it can be
+// used by Go code that reuses the shell test syntax, such as rule
+// engines.
+//
+// Variables are read from vars, as with EvalArithm. File tests query
+// fs, with relative paths starting at its root directory, and the -r,
+// -w and -x tests only look at the files' permission bits. If fs is
+// nil, the OS filesystem and the current directory are used instead.
+func EvalTest(expr syntax.TestExpr, vars Vars, fs StatFS) (bool, error) {
+	var ok bool
+	err := evalExpr(expr, vars, "a test expression", func(r *Runner) {
+		if fs == nil {
+			r.Open = DefaultOpen
+			return
+		}
+		r.fs = fs
+		r.Dir = "/"
+		r.setVar("PWD", nil, r.Dir)
+		r.Open = func(ctx Ctxt, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			info, err := fs.Stat(path)
+			if err != nil {
+				return nil, &os.PathError{Op: "open", Path: path, Err: err}
+			}
+			mode := os.FileMode(0444)
+			if flag&os.O_WRONLY != 0 {
+				mode = 0222
+			}
+			if info.Mode()&mode == 0 {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+			}
+			return devNull{}, nil
+		}
+	}, func(r *Runner) {
+		ok = r.bashTest(expr) != ""
+		if r.exit == 2 {
+			r.setErr(fmt.Errorf("invalid regular expression"))
+		}
+	})
+	return ok, err
+}
+
 // non-empty string is true, empty string is false
 func (r *Runner) bashTest(expr syntax.TestExpr) string {
 	switch x := expr.(type) {
@@ -25,13 +75,8 @@ func (r *Runner) bashTest(expr syntax.TestExpr) string {
 		switch x.Op {
 		case syntax.TsMatch, syntax.TsNoMatch:
 			str := r.loneWord(x.X.(*syntax.Word))
-			var buf bytes.Buffer
-			yw := x.Y.(*syntax.Word)
-			for _, field := range r.wordFields(yw.Parts, false) {
-				escaped, _ := escapedGlob(field)
-				buf.WriteString(escaped)
-			}
-			if match(buf.String(), str) == (x.Op == syntax.TsMatch) {
+			pat := r.pattern(x.Y.(*syntax.Word))
+			if match(pat, str) == (x.Op == syntax.TsMatch) {
 				return "1"
 			}
 			return ""
@@ -97,7 +142,24 @@ func (r *Runner) binTest(op syntax.BinTestOperator, x, y string) bool {
 }
 
 func (r *Runner) stat(name string) os.FileInfo {
-	info, _ := os.Stat(r.relPath(name))
+	path := r.relPath(name)
+	var info os.FileInfo
+	if r.fs != nil {
+		info, _ = r.fs.Stat(path)
+	} else {
+		info, _ = os.Stat(path)
+	}
+	return info
+}
+
+func (r *Runner) lstat(name string) os.FileInfo {
+	path := r.relPath(name)
+	var info os.FileInfo
+	if r.fs != nil {
+		info, _ = r.fs.Lstat(path)
+	} else {
+		info, _ = os.Lstat(path)
+	}
 	return info
 }
 
@@ -126,7 +188,7 @@ func (r *Runner) unTest(op syntax.UnTestOperator, x string) bool {
 	case syntax.TsSocket:
 		return r.statMode(x, os.ModeSocket)
 	case syntax.TsSmbLink:
-		info, _ := os.Lstat(r.relPath(x))
+		info := r.lstat(x)
 		return info != nil && info.Mode()&os.ModeSymlink != 0
 	case syntax.TsSticky:
 		return r.statMode(x, os.ModeSticky)
@@ -150,8 +212,8 @@ func (r *Runner) unTest(op syntax.UnTestOperator, x string) bool {
 		}
 		return err == nil
 	case syntax.TsExec:
-		_, err := exec.LookPath(r.relPath(x))
-		return err == nil
+		info := r.stat(x)
+		return info != nil && !info.IsDir() && info.Mode()&0111 != 0
 	case syntax.TsNoEmpty:
 		info := r.stat(x)
 		return info != nil && info.Size() > 0
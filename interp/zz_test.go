@@ -0,0 +1,45 @@
+package interp
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/syntax"
+)
+
+func TestZZCases(t *testing.T) {
+	f, _ := os.Open("/tmp/cases.txt")
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			continue
+		}
+		dir, _ := ioutil.TempDir("", "zz")
+		file, err := syntax.NewParser().Parse(strings.NewReader(line), "")
+		var cb concBuffer
+		if err != nil {
+			cb.WriteString(err.Error())
+		} else {
+			r := Runner{Dir: dir, Stdout: &cb, Stderr: &cb}
+			r.Reset()
+			if err := r.Run(file); err != nil {
+				cb.WriteString(err.Error())
+			}
+		}
+		cmd := exec.Command("bash", "-c", line)
+		cmd.Dir = dir
+		cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=/tmp"}
+		out, _ := cmd.CombinedOutput()
+		mark := "SAME"
+		if string(out) != cb.String() {
+			mark = "DIFF"
+		}
+		t.Logf("%s %s\n  gosh: %q\n  bash: %q", mark, line, cb.String(), out)
+		os.RemoveAll(dir)
+	}
+}
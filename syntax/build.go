@@ -0,0 +1,405 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// The functions below build nodes that can be printed and interpreted,
+// so that Go programs can generate shell programs without having to
+// concatenate strings or to know the invariants of each node.
+//
+// For example, this builds "git status | grep -q modified":
+//
+//	NewPipe(NewCall("git", "status"), NewCall("grep", "-q", "modified"))
+
+// NewFile returns a file with a series of statements, such as those
+// built with NewCall. The positions of all the nodes are set so that
+// the printer puts each statement on a separate line, overwriting any
+// positions they had, so the statements should be complete before
+// calling NewFile.
+func NewFile(stmts ...*Stmt) *File {
+	f := &File{StmtList: StmtList{Stmts: stmts}}
+	var l layout
+	l.stmts(&f.StmtList)
+	return f
+}
+
+func newLit(s string) *Lit { return &Lit{Value: s} }
+
+// NewWord returns a word whose value is s, without any expansions. The
+// word is quoted if needed, much like with Quote.
+func NewWord(s string) *Word {
+	return &Word{Parts: literalParts(s, false)}
+}
+
+// literalParts returns the word parts of a literal string, quoting it
+// if needed or if force is true.
+func literalParts(s string, force bool) []WordPart {
+	if s != "" && !force && !needsQuoting(s) {
+		return []WordPart{newLit(s)}
+	}
+	// single quotes cannot be escaped within single quotes, so
+	// they must be escaped between them
+	var parts []WordPart
+	for i, part := range strings.Split(s, "'") {
+		if i > 0 {
+			parts = append(parts, newLit(`\'`))
+		}
+		if part != "" {
+			parts = append(parts, &SglQuoted{Value: part})
+		}
+	}
+	if len(parts) == 0 {
+		parts = append(parts, &SglQuoted{})
+	}
+	return parts
+}
+
+// NewParam returns a word that expands a parameter, such as a variable.
+// It is double-quoted, so that its value is not split nor globbed, as
+// in "$name".
+func NewParam(name string) *Word {
+	pe := &ParamExp{Short: true, Param: newLit(name)}
+	return &Word{Parts: []WordPart{&DblQuoted{Parts: []WordPart{pe}}}}
+}
+
+// NewCmdSubst returns a word that is replaced by the output of a series
+// of statements. It is double-quoted like with NewParam, as in
+// "$(stmts)".
+func NewCmdSubst(stmts ...*Stmt) *Word {
+	cs := &CmdSubst{StmtList: StmtList{Stmts: stmts}}
+	return &Word{Parts: []WordPart{&DblQuoted{Parts: []WordPart{cs}}}}
+}
+
+func newStmt(cmd Command) *Stmt { return &Stmt{Cmd: cmd} }
+
+// NewCall returns a statement running a simple command, such as a
+// program or a function, with literal arguments as given to NewWord.
+func NewCall(args ...string) *Stmt {
+	words := make([]*Word, len(args))
+	for i, arg := range args {
+		words[i] = NewWord(arg)
+	}
+	return NewCallWords(words...)
+}
+
+// NewCallWords is like NewCall, but with words that may expand.
+func NewCallWords(words ...*Word) *Stmt {
+	return newStmt(&CallExpr{Args: words})
+}
+
+// NewAssign returns a statement setting a variable, as in
+// "name=value".
+func NewAssign(name string, value *Word) *Stmt {
+	return newStmt(&CallExpr{Assigns: []*Assign{{Name: newLit(name), Value: value}}})
+}
+
+// NewRedirect returns a redirection, which can be added to a
+// statement's Redirs. For example, NewRedirect(RdrOut, "out.txt")
+// results in ">out.txt".
+func NewRedirect(op RedirOperator, word string) *Redirect {
+	return &Redirect{Op: op, Word: NewWord(word)}
+}
+
+func newBinary(op BinCmdOperator, stmts []*Stmt, leftAssoc bool) *Stmt {
+	if len(stmts) == 0 {
+		panic("at least one statement is required")
+	}
+	if leftAssoc {
+		s := stmts[0]
+		for _, y := range stmts[1:] {
+			s = newStmt(&BinaryCmd{Op: op, X: s, Y: y})
+		}
+		return s
+	}
+	s := stmts[len(stmts)-1]
+	for i := len(stmts) - 2; i >= 0; i-- {
+		s = newStmt(&BinaryCmd{Op: op, X: stmts[i], Y: s})
+	}
+	return s
+}
+
+// NewPipe returns a pipeline of one or more statements, as in
+// "a | b | c".
+func NewPipe(stmts ...*Stmt) *Stmt { return newBinary(Pipe, stmts, false) }
+
+// NewAnd returns a list of one or more statements where each one is
+// only run if the previous one succeeded, as in "a && b && c".
+func NewAnd(stmts ...*Stmt) *Stmt { return newBinary(AndStmt, stmts, true) }
+
+// NewOr returns a list of one or more statements where each one is only
+// run if the previous one failed, as in "a || b || c".
+func NewOr(stmts ...*Stmt) *Stmt { return newBinary(OrStmt, stmts, true) }
+
+// NewIf returns an if clause. The else branch is omitted if els is
+// empty.
+func NewIf(cond *Stmt, then, els []*Stmt) *Stmt {
+	return newStmt(&IfClause{
+		Cond: StmtList{Stmts: []*Stmt{cond}},
+		Then: StmtList{Stmts: then},
+		Else: StmtList{Stmts: els},
+	})
+}
+
+// NewWhile returns a while loop.
+func NewWhile(cond *Stmt, body ...*Stmt) *Stmt {
+	return newStmt(&WhileClause{
+		Cond: StmtList{Stmts: []*Stmt{cond}},
+		Do:   StmtList{Stmts: body},
+	})
+}
+
+// NewFor returns a for loop setting a variable to each of a series of
+// words, as in "for name in items; do body; done".
+func NewFor(name string, items []*Word, body ...*Stmt) *Stmt {
+	return newStmt(&ForClause{
+		Loop: &WordIter{Name: newLit(name), Items: items},
+		Do:   StmtList{Stmts: body},
+	})
+}
+
+// NewBlock returns a group of statements run in the current shell, as
+// in "{ stmts; }".
+func NewBlock(stmts ...*Stmt) *Stmt {
+	return newStmt(&Block{StmtList: StmtList{Stmts: stmts}})
+}
+
+// NewSubshell returns a group of statements run in a subshell, as in
+// "(stmts)".
+func NewSubshell(stmts ...*Stmt) *Stmt {
+	return newStmt(&Subshell{StmtList: StmtList{Stmts: stmts}})
+}
+
+// NewFunc returns a function declaration, as in "name() { body; }".
+func NewFunc(name string, body ...*Stmt) *Stmt {
+	return newStmt(&FuncDecl{Name: newLit(name), Body: NewBlock(body...)})
+}
+
+// Format parses a program where each "%s" is a placeholder for one of
+// args, in order. Each argument is inserted as a literal string, quoted
+// as needed, so that it is never split into multiple fields nor
+// expanded. This avoids the injection bugs that come with building
+// programs via fmt.Sprintf:
+//
+//	f, err := Format("rm -- %s && echo removed %s", name, name)
+//
+// A placeholder may be part of a larger word, or be within double
+// quotes. Placeholders within single quotes are left as they are, so
+// '%s' can be used to write a literal "%s". An error is returned if the
+// program cannot be parsed, if the number of placeholders and arguments
+// differ, or if a placeholder is within a heredoc.
+func Format(src string, args ...string) (*File, error) {
+	f, err := NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		return nil, err
+	}
+	fm := formatter{args: args}
+	Walk(f, fm.node)
+	if fm.err != nil {
+		return nil, fm.err
+	}
+	if fm.n != len(args) {
+		return nil, fmt.Errorf("got %d placeholders but %d arguments", fm.n, len(args))
+	}
+	return f, nil
+}
+
+type formatter struct {
+	args []string
+	n    int // number of placeholders seen
+	err  error
+}
+
+func (f *formatter) node(node Node) bool {
+	switch x := node.(type) {
+	case *Word:
+		x.Parts = f.parts(x.Parts, false, len(x.Parts) == 1)
+		return false
+	case *Redirect:
+		if x.Word != nil {
+			Walk(x.Word, f.node)
+		}
+		if x.Hdoc != nil {
+			for _, part := range x.Hdoc.Parts {
+				if lit, ok := part.(*Lit); ok && strings.Contains(lit.Value, "%s") {
+					if f.err == nil {
+						f.err = fmt.Errorf("%s: placeholders are not supported in heredocs", lit.Pos())
+					}
+					continue
+				}
+				Walk(part, f.node)
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parts replaces the placeholders in a list of word parts. whole
+// reports whether the parts make up an entire word.
+func (f *formatter) parts(parts []WordPart, quoted, whole bool) []WordPart {
+	var res []WordPart
+	for _, part := range parts {
+		switch x := part.(type) {
+		case *Lit:
+			chunks := strings.Split(x.Value, "%s")
+			for i, chunk := range chunks {
+				if i > 0 {
+					for _, arg := range f.arg(quoted, whole && x.Value == "%s") {
+						setPos(arg, x.ValuePos)
+						res = append(res, arg)
+					}
+				}
+				if chunk != "" {
+					res = append(res, &Lit{ValuePos: x.ValuePos, ValueEnd: x.ValueEnd, Value: chunk})
+				}
+			}
+			continue
+		case *DblQuoted:
+			x.Parts = f.parts(x.Parts, true, false)
+		default:
+			Walk(x, f.node)
+		}
+		res = append(res, part)
+	}
+	return res
+}
+
+// dquoteEscaper escapes the characters that are special within double
+// quotes.
+var dquoteEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+
+func (f *formatter) arg(quoted, whole bool) []WordPart {
+	f.n++
+	if f.n > len(f.args) {
+		return nil
+	}
+	s := f.args[f.n-1]
+	if quoted {
+		return []WordPart{newLit(dquoteEscaper.Replace(s))}
+	}
+	// quote the argument if it's next to other parts, as it could
+	// otherwise change their meaning, like "%s=foo"
+	return literalParts(s, !whole)
+}
+
+// layout assigns increasing line numbers to the statements and reserved
+// words in a tree, as the printer uses them to decide where newlines
+// go.
+type layout struct {
+	line, offs uint
+}
+
+// pos returns a position on the current line, after any other one.
+func (l *layout) pos() Pos {
+	l.offs++
+	return Pos{offs: uint32(l.offs), line: uint16(l.line), col: 1}
+}
+
+func (l *layout) next() Pos {
+	l.line++
+	return l.pos()
+}
+
+// stmts puts each statement on a new line.
+func (l *layout) stmts(sl *StmtList) {
+	for _, s := range sl.Stmts {
+		l.next()
+		l.stmt(s)
+	}
+}
+
+// inline puts the first statement on the current line.
+func (l *layout) inline(sl *StmtList) {
+	for i, s := range sl.Stmts {
+		if i > 0 {
+			l.next()
+		}
+		l.stmt(s)
+	}
+}
+
+func (l *layout) stmt(s *Stmt) {
+	s.Position = l.pos()
+	switch x := s.Cmd.(type) {
+	case *CallExpr:
+		for _, as := range x.Assigns {
+			l.inlineNode(as)
+		}
+		for _, w := range x.Args {
+			l.inlineNode(w)
+		}
+	case *BinaryCmd:
+		l.stmt(x.X)
+		x.OpPos = l.pos()
+		l.stmt(x.Y)
+	case *IfClause:
+		x.IfPos = l.pos()
+		l.inline(&x.Cond)
+		x.ThenPos = l.pos()
+		l.stmts(&x.Then)
+		if len(x.Else.Stmts) > 0 {
+			x.ElsePos = l.next()
+			l.stmts(&x.Else)
+		}
+		x.FiPos = l.next()
+	case *WhileClause:
+		x.WhilePos = l.pos()
+		l.inline(&x.Cond)
+		x.DoPos = l.pos()
+		l.stmts(&x.Do)
+		x.DonePos = l.next()
+	case *ForClause:
+		x.ForPos = l.pos()
+		if wi, ok := x.Loop.(*WordIter); ok {
+			l.inlineNode(wi)
+		}
+		x.DoPos = l.pos()
+		l.stmts(&x.Do)
+		x.DonePos = l.next()
+	case *Block:
+		x.Lbrace = l.pos()
+		l.stmts(&x.StmtList)
+		x.Rbrace = l.next()
+	case *Subshell:
+		x.Lparen = l.pos()
+		l.stmts(&x.StmtList)
+		x.Rparen = l.next()
+	case *FuncDecl:
+		x.Position = l.pos()
+		l.stmt(x.Body)
+	}
+	for _, r := range s.Redirs {
+		l.inlineNode(r)
+	}
+}
+
+// inlineNode puts a node and all of its children on the current line.
+func (l *layout) inlineNode(node Node) {
+	Walk(node, func(node Node) bool {
+		if node != nil {
+			setPos(node, l.pos())
+		}
+		return true
+	})
+}
+
+// setPos sets all the positions within a node, not including its
+// children.
+func setPos(node Node, pos Pos) {
+	v := reflect.ValueOf(node)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Field(i); field.Type() == posType && field.CanSet() {
+			field.Set(reflect.ValueOf(pos))
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+	redir := NewCall("echo", "foo")
+	redir.Redirs = append(redir.Redirs, NewRedirect(RdrOut, "out file"))
+	tests := []struct {
+		stmts []*Stmt
+		want  string
+	}{
+		{[]*Stmt{NewCall("foo", "bar baz", "it's", "")}, `foo 'bar baz' 'it'\''s' ''`},
+		{[]*Stmt{NewCall("a"), NewCall("b")}, "a\nb"},
+		{[]*Stmt{NewAssign("foo", NewWord("*"))}, "foo='*'"},
+		{[]*Stmt{redir}, "echo foo >'out file'"},
+		{
+			[]*Stmt{NewCallWords(NewWord("echo"), NewParam("foo"), NewCmdSubst(NewCall("date")))},
+			`echo "$foo" "$(date)"`,
+		},
+		{[]*Stmt{NewPipe(NewCall("a"), NewCall("b"), NewCall("c"))}, "a | b | c"},
+		{[]*Stmt{NewAnd(NewCall("a"), NewCall("b"))}, "a && b"},
+		{[]*Stmt{NewOr(NewCall("a"), NewCall("b"))}, "a || b"},
+		{
+			[]*Stmt{NewIf(NewCall("a"), []*Stmt{NewCall("b"), NewCall("c")}, nil)},
+			"if a; then\n\tb\n\tc\nfi",
+		},
+		{
+			[]*Stmt{NewIf(NewCall("a"), []*Stmt{NewCall("b")}, []*Stmt{NewCall("c")})},
+			"if a; then\n\tb\nelse\n\tc\nfi",
+		},
+		{
+			[]*Stmt{NewWhile(NewCall("a"), NewCall("b"))},
+			"while a; do\n\tb\ndone",
+		},
+		{
+			[]*Stmt{NewFor("i", []*Word{NewWord("a b"), NewWord("c")}, NewCall("d"))},
+			"for i in 'a b' c; do\n\td\ndone",
+		},
+		{[]*Stmt{NewBlock(NewCall("a"))}, "{\n\ta\n}"},
+		{[]*Stmt{NewSubshell(NewCall("a"))}, "(\n\ta\n)"},
+		{
+			[]*Stmt{NewFunc("foo", NewCall("a"), NewCall("b"))},
+			"foo() {\n\ta\n\tb\n}",
+		},
+	}
+	for i, tc := range tests {
+		f := NewFile(tc.stmts...)
+		var buf bytes.Buffer
+		if err := NewPrinter().Print(&buf, f); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		got := strings.TrimSuffix(buf.String(), "\n")
+		if got != tc.want {
+			t.Errorf("#%d: got:\n%s\nwant:\n%s", i, got, tc.want)
+			continue
+		}
+		parsed, err := NewParser().Parse(&buf, "")
+		if err != nil {
+			t.Errorf("#%d: cannot parse printed program: %v", i, err)
+			continue
+		}
+		if d := Compare(f, parsed, 0); d != nil {
+			t.Errorf("#%d: parsed program differs: %s", i, d)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		args []string
+		want string
+	}{
+		{"echo %s", []string{"foo"}, "echo foo"},
+		{"echo %s", []string{"a b; rm -rf /"}, "echo 'a b; rm -rf /'"},
+		{"echo %s", []string{""}, "echo ''"},
+		{"echo %s %s", []string{"$foo", "it's"}, `echo '$foo' 'it'\''s'`},
+		{"%s=%s", []string{"foo", "bar"}, "'foo'='bar'"},
+		{"echo %s=x", []string{"foo"}, "echo 'foo'=x"},
+		{"echo foo%sbar", []string{"*"}, "echo foo'*'bar"},
+		{`echo "x %s"`, []string{"$(a) \\ \"`b`"}, "echo \"x \\$(a) \\\\ \\\"\\`b\\`\""},
+		{"echo '%s' %s", []string{"foo"}, "echo '%s' foo"},
+		{`a%s"$(b %s)"%s`, []string{"1", "2", "3"}, `a'1'"$(b 2)"'3'`},
+		{"foo >%s", []string{"out file"}, "foo >'out file'"},
+		{"foo <<EOF\n$(bar %s)\nEOF", []string{"x y"}, "foo <<EOF\n$(bar 'x y')\nEOF"},
+	}
+	for i, tc := range tests {
+		f, err := Format(tc.src, tc.args...)
+		if err != nil {
+			t.Errorf("#%d: unexpected error: %v", i, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := NewPrinter().Print(&buf, f); err != nil {
+			t.Fatalf("#%d: unexpected error: %v", i, err)
+		}
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.want {
+			t.Errorf("#%d: got:\n%s\nwant:\n%s", i, got, tc.want)
+		}
+	}
+}
+
+func TestFormatErr(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		args []string
+		want string
+	}{
+		{"echo %s", nil, "got 1 placeholders but 0 arguments"},
+		{"echo %s", []string{"a", "b"}, "got 1 placeholders but 2 arguments"},
+		{"cat <<EOF\n%s\nEOF", []string{"a"}, "2:1: placeholders are not supported in heredocs"},
+		{"foo(", nil, `1:1: "foo(" must be followed by )`},
+	}
+	for i, tc := range tests {
+		_, err := Format(tc.src, tc.args...)
+		if err == nil {
+			t.Errorf("#%d: expected error %q", i, tc.want)
+		} else if got := err.Error(); got != tc.want {
+			t.Errorf("#%d: got error %q, want %q", i, got, tc.want)
+		}
+	}
+}
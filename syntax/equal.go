@@ -0,0 +1,174 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// CompareMode changes the way in which Compare looks at nodes.
+type CompareMode uint
+
+const (
+	// IgnoreComments makes comments not count as differences.
+	IgnoreComments CompareMode = 1 << iota
+)
+
+// NodeDiff is the first difference found between two nodes by Compare.
+type NodeDiff struct {
+	// Path leads to the value that differs from the nodes being
+	// compared, such as "File.Stmts[0].Cmd.Args[1]". It is empty if
+	// the nodes are of different types.
+	Path string
+
+	// X and Y are the values that differ. They are nodes, such as
+	// when their types differ or when one of them is missing from a
+	// list, or the values of their fields otherwise. A missing node
+	// is nil.
+	X, Y interface{}
+}
+
+func (d *NodeDiff) String() string {
+	s := diffValue(d.X) + " != " + diffValue(d.Y)
+	if d.Path != "" {
+		s = d.Path + ": " + s
+	}
+	return s
+}
+
+func diffValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "nil"
+	case Node:
+		return fmt.Sprintf("%T", x)
+	case string:
+		return fmt.Sprintf("%q", x)
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// Equal reports whether two nodes are equal, ignoring their positions.
+// Comments are taken into account; use Compare with IgnoreComments to
+// ignore them too.
+func Equal(x, y Node) bool {
+	return Compare(x, y, 0) == nil
+}
+
+// Compare walks two nodes side by side and returns the first difference
+// between them, or nil if they are equal. Positions are never taken
+// into account, so it can tell whether two programs are the same
+// regardless of their formatting, such as after a transformation.
+func Compare(x, y Node, mode CompareMode) *NodeDiff {
+	if x == nil || y == nil {
+		if x == nil && y == nil {
+			return nil
+		}
+		return &NodeDiff{X: x, Y: y}
+	}
+	vx, vy := reflect.ValueOf(x), reflect.ValueOf(y)
+	path := ""
+	if vx.Type() == vy.Type() && vx.Kind() == reflect.Ptr {
+		path = vx.Type().Elem().Name()
+	}
+	c := comparer{mode: mode}
+	return c.compare(path, vx, vy)
+}
+
+var (
+	posType      = reflect.TypeOf(Pos{})
+	commentsType = reflect.TypeOf([]Comment(nil))
+)
+
+type comparer struct {
+	mode CompareMode
+}
+
+func (c *comparer) compare(path string, x, y reflect.Value) *NodeDiff {
+	diff := func() *NodeDiff {
+		return &NodeDiff{Path: path, X: x.Interface(), Y: y.Interface()}
+	}
+	switch x.Kind() {
+	case reflect.Interface:
+		if x.IsNil() || y.IsNil() {
+			if x.IsNil() != y.IsNil() {
+				return diff()
+			}
+			return nil
+		}
+		x, y = x.Elem(), y.Elem()
+		if x.Type() != y.Type() {
+			return diff()
+		}
+		return c.compare(path, x, y)
+	case reflect.Ptr:
+		if x.Type() != y.Type() {
+			return diff()
+		}
+		if x.IsNil() || y.IsNil() {
+			if x.IsNil() != y.IsNil() {
+				return diff()
+			}
+			return nil
+		}
+		return c.compare(path, x.Elem(), y.Elem())
+	case reflect.Struct:
+		if x.Type() != y.Type() {
+			return diff()
+		}
+		t := x.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			switch {
+			case field.PkgPath != "": // unexported
+				continue
+			case field.Type == posType:
+				continue
+			case field.Type == commentsType && c.mode&IgnoreComments != 0:
+				continue
+			}
+			fpath := path
+			if !field.Anonymous {
+				fpath += "." + field.Name
+			}
+			if d := c.compare(fpath, x.Field(i), y.Field(i)); d != nil {
+				return d
+			}
+		}
+		return nil
+	case reflect.Slice:
+		for i := 0; i < x.Len() || i < y.Len(); i++ {
+			epath := fmt.Sprintf("%s[%d]", path, i)
+			if i >= x.Len() || i >= y.Len() {
+				d := &NodeDiff{Path: epath}
+				if i < x.Len() {
+					d.X = sliceElem(x.Index(i))
+				} else {
+					d.Y = sliceElem(y.Index(i))
+				}
+				return d
+			}
+			if d := c.compare(epath, x.Index(i), y.Index(i)); d != nil {
+				return d
+			}
+		}
+		return nil
+	}
+	if x.Interface() != y.Interface() {
+		return diff()
+	}
+	return nil
+}
+
+// sliceElem returns an element of a list of nodes, such as a Comment,
+// as a Node if possible.
+func sliceElem(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Struct && v.CanAddr() {
+		if n, ok := v.Addr().Interface().(Node); ok {
+			return n
+		}
+	}
+	return v.Interface()
+}
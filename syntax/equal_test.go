@@ -0,0 +1,89 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompareFileTests(t *testing.T) {
+	t.Parallel()
+	parserBash := NewParser(KeepComments)
+	parserPosix := NewParser(KeepComments, Variant(LangPOSIX))
+	parserMirBSD := NewParser(KeepComments, Variant(LangMirBSDKorn))
+	for i, c := range fileTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			parser := parserPosix
+			if c.Bash != nil {
+				parser = parserBash
+			} else if c.MirBSDKorn != nil {
+				parser = parserMirBSD
+			}
+			first, err := parser.Parse(strings.NewReader(c.Strs[0]), "")
+			if err != nil {
+				t.Fatalf("Unexpected error in %q: %v", c.Strs[0], err)
+			}
+			for _, in := range c.Strs[1:] {
+				prog, err := parser.Parse(strings.NewReader(in), "")
+				if err != nil {
+					t.Fatalf("Unexpected error in %q: %v", in, err)
+				}
+				if d := Compare(first, prog, IgnoreComments); d != nil {
+					t.Fatalf("%q and %q differ: %s", c.Strs[0], in, d)
+				}
+			}
+		})
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		x, y string
+		mode CompareMode
+		want string // the diff, if any
+	}{
+		{"foo  bar", "foo \\\n\tbar", 0, ""},
+		{"foo # a", "foo # b", IgnoreComments, ""},
+		{"foo # a", "foo # b", 0, `File.Stmts[0].Comments[0].Text: " a" != " b"`},
+		{"foo # a", "foo", 0, "File.Stmts[0].Comments[0]: *syntax.Comment != nil"},
+		{"foo bar", "foo baz", 0, `File.Stmts[0].Cmd.Args[1].Parts[0].Value: "bar" != "baz"`},
+		{"foo bar", "foo", 0, "File.Stmts[0].Cmd.Args[1]: *syntax.Word != nil"},
+		{"foo", "foo; bar", 0, "File.Stmts[1]: nil != *syntax.Stmt"},
+		{"foo", "(foo)", 0, "File.Stmts[0].Cmd: *syntax.CallExpr != *syntax.Subshell"},
+		{"foo &", "foo", 0, "File.Stmts[0].Background: true != false"},
+		{"a=b", "a+=b", 0, "File.Stmts[0].Cmd.Assigns[0].Append: false != true"},
+		{`"$a"`, `"${a}"`, 0, "File.Stmts[0].Cmd.Args[0].Parts[0].Parts[0].Short: true != false"},
+	}
+	parser := NewParser(KeepComments)
+	for _, tc := range tests {
+		x, err := parser.Parse(strings.NewReader(tc.x), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := parser.Parse(strings.NewReader(tc.y), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if d := Compare(x, y, tc.mode); d != nil {
+			got = d.String()
+		}
+		if got != tc.want {
+			t.Fatalf("wrong diff between %q and %q:\nwant: %s\ngot:  %s",
+				tc.x, tc.y, tc.want, got)
+		}
+		if eq := Equal(x, y); eq != (got == "" && tc.mode == 0) {
+			t.Fatalf("Equal(%q, %q) returned %t", tc.x, tc.y, eq)
+		}
+	}
+	lit := &Lit{Value: "foo"}
+	if !Equal(lit, &Lit{ValuePos: Pos{line: 2}, Value: "foo"}) {
+		t.Fatalf("Lits with different positions should be equal")
+	}
+	if d := Compare(lit, &Word{}, 0); d == nil || d.String() != "*syntax.Lit != *syntax.Word" {
+		t.Fatalf("wrong diff between a Lit and a Word: %v", d)
+	}
+}
@@ -113,6 +113,15 @@ func (p *Parser) fill() {
 	if p.readErr == nil {
 		n, err = p.src.Read(p.readBuf[left:])
 		p.readErr = err
+		if p.maxSize > 0 && p.offs+left+n > p.maxSize {
+			n, err = 0, &LimitError{
+				Filename: p.f.Name,
+				Pos:      p.npos,
+				Size:     true,
+				Max:      p.maxSize,
+			}
+			p.readErr = err
+		}
 	} else {
 		n, err = 0, p.readErr
 	}
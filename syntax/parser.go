@@ -29,6 +29,24 @@ func Variant(l LangVariant) func(*Parser) {
 	return func(p *Parser) { p.lang = l }
 }
 
+// MaxDepth limits how deeply the parser may recurse into nested
+// constructs, such as statements, words and arithmetic or test
+// expressions. Going past the limit results in a *LimitError. A limit
+// of zero, the default, means no limit.
+//
+// This is useful when parsing untrusted input, as very deeply nested
+// programs could otherwise exhaust the stack.
+func MaxDepth(n int) func(*Parser) {
+	return func(p *Parser) { p.maxDepth = n }
+}
+
+// MaxSize limits the number of bytes that the parser will read from
+// its input. Going past the limit results in a *LimitError. A limit of
+// zero, the default, means no limit.
+func MaxSize(n int) func(*Parser) {
+	return func(p *Parser) { p.maxSize = n }
+}
+
 // NewParser allocates a new Parser and applies any number of options.
 func NewParser(options ...func(*Parser)) *Parser {
 	p := &Parser{helperBuf: new(bytes.Buffer)}
@@ -59,14 +77,25 @@ func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
 	return p.f, p.err
 }
 
-func (p *Parser) Stmts(r io.Reader, fn func(*Stmt)) error {
+// Stmts reads and parses statements one at a time, calling a function
+// each time one is parsed. If the function returns false, parsing is
+// stopped and the function is not called again.
+//
+// Unlike Parse, a File holding all the statements is never built, so
+// the input may be arbitrarily long. Each statement is also available
+// as soon as it has been read, so the statements can be run as they are
+// parsed, as done by an interactive shell.
+func (p *Parser) Stmts(r io.Reader, fn func(*Stmt) bool) error {
 	p.reset()
 	p.f = &File{}
 	p.src = r
 	p.rune()
 	p.next()
-	p.stmts(fn)
-	if p.err == nil {
+	ok := p.stmts(func(s *Stmt) bool {
+		// don't hand out statements that failed to parse
+		return p.err == nil && fn(s)
+	})
+	if ok && p.err == nil {
 		// EOF immediately after heredoc word so no newline to
 		// trigger it
 		p.doHeredocs()
@@ -74,6 +103,49 @@ func (p *Parser) Stmts(r io.Reader, fn func(*Stmt)) error {
 	return p.err
 }
 
+// Arithmetic parses a single arithmetic expression, such as the ones
+// found within $(( and )), reading it from r. The entire input must be
+// part of the expression.
+func (p *Parser) Arithmetic(r io.Reader) (ArithmExpr, error) {
+	p.reset()
+	p.f = &File{}
+	p.src = r
+	p.rune()
+	p.quote = arithmExpr
+	p.next()
+	x := p.arithmExpr(0, false, false)
+	switch {
+	case p.err != nil:
+	case x == nil:
+		p.posErr(Pos{line: 1, col: 1}, "an arithmetic expression must not be empty")
+	case p.tok != _EOF:
+		p.curErr("not a valid arithmetic operator: %s", p.tok)
+	}
+	return x, p.err
+}
+
+// Test reads and parses a single test expression, as found between
+// "[[" and "]]", such as "-f foo && $bar == b*". It is meant for Go
+// code that reuses the shell test syntax, for example in rule engines.
+func (p *Parser) Test(r io.Reader) (TestExpr, error) {
+	p.reset()
+	p.f = &File{}
+	p.src = r
+	p.rune()
+	p.next()
+	x := p.testExpr(illegalTok, Pos{line: 1, col: 1}, false)
+	switch {
+	case p.err != nil:
+	case x == nil:
+		p.posErr(Pos{line: 1, col: 1}, "a test expression must not be empty")
+	case p.tok == _LitWord:
+		p.curErr("not a valid test operator: %s", p.val)
+	case p.tok != _EOF:
+		p.curErr("not a valid test operator: %v", p.tok)
+	}
+	return x, p.err
+}
+
 // Parser holds the internal state of the parsing mechanism of a
 // program.
 type Parser struct {
@@ -103,6 +175,9 @@ type Parser struct {
 	keepComments bool
 	lang         LangVariant
 
+	maxDepth, maxSize int
+	depth             int // current nesting depth
+
 	forbidNested bool
 
 	// list of pending heredoc bodies
@@ -137,6 +212,7 @@ func (p *Parser) reset() {
 	p.npos = Pos{line: 1, col: 1}
 	p.r, p.w = 0, 0
 	p.err, p.readErr = nil, nil
+	p.depth = 0
 	p.quote, p.forbidNested = noState, false
 	p.heredocs, p.buriedHdocs = p.heredocs[:0], 0
 	p.accComs, p.curComs = nil, &p.accComs
@@ -478,6 +554,39 @@ func (e *ParseError) Error() string {
 	return fmt.Sprintf("%s:%s: %s", e.Filename, e.Pos.String(), e.Text)
 }
 
+// LimitError is returned by the parser when the input goes past one of
+// the limits set via MaxDepth or MaxSize.
+type LimitError struct {
+	Filename string
+	Pos
+	Size bool // whether the size limit was hit, as opposed to the depth one
+	Max  int
+}
+
+func (e *LimitError) Error() string {
+	text := fmt.Sprintf("maximum nesting depth of %d exceeded", e.Max)
+	if e.Size {
+		text = fmt.Sprintf("maximum input size of %d bytes exceeded", e.Max)
+	}
+	if e.Filename == "" {
+		return fmt.Sprintf("%s: %s", e.Pos.String(), text)
+	}
+	return fmt.Sprintf("%s:%s: %s", e.Filename, e.Pos.String(), text)
+}
+
+// deeper increases the nesting depth, erroring if the limit is hit.
+// Each call must be followed by decreasing p.depth once the nested
+// construct has been parsed.
+func (p *Parser) deeper() {
+	if p.depth++; p.maxDepth > 0 && p.depth > p.maxDepth {
+		p.errPass(&LimitError{
+			Filename: p.f.Name,
+			Pos:      p.pos,
+			Max:      p.maxDepth,
+		})
+	}
+}
+
 func (p *Parser) posErr(pos Pos, format string, a ...interface{}) {
 	p.errPass(&ParseError{
 		Filename: p.f.Name,
@@ -490,7 +599,9 @@ func (p *Parser) curErr(format string, a ...interface{}) {
 	p.posErr(p.pos, format, a...)
 }
 
-func (p *Parser) stmts(fn func(*Stmt), stops ...string) {
+// stmts parses statements until one of the stop words or the end of
+// input. It returns false if fn returned false, stopping early.
+func (p *Parser) stmts(fn func(*Stmt) bool, stops ...string) bool {
 	gotEnd := true
 loop:
 	for p.tok != _EOF {
@@ -529,18 +640,22 @@ loop:
 		if s, end := p.getStmt(true, false, false); s == nil {
 			p.invalidStmtStart()
 		} else {
-			fn(s)
+			if !fn(s) {
+				return false
+			}
 			gotEnd = end
 		}
 	}
+	return true
 }
 
 func (p *Parser) stmtList(stops ...string) (sl StmtList) {
-	fn := func(s *Stmt) {
+	fn := func(s *Stmt) bool {
 		if sl.Stmts == nil {
 			sl.Stmts = p.stList()
 		}
 		sl.Stmts = append(sl.Stmts, s)
+		return true
 	}
 	p.stmts(fn, stops...)
 	sl.Last, p.accComs = p.accComs, nil
@@ -604,6 +719,10 @@ func (p *Parser) wordPart() WordPart {
 		l := p.lit(p.pos, p.val)
 		p.next()
 		return l
+	}
+	p.deeper()
+	defer func() { p.depth-- }()
+	switch p.tok {
 	case dollBrace:
 		p.ensureNoNested()
 		switch p.r {
@@ -911,7 +1030,9 @@ func (p *Parser) arithmExpr(level int, compact, tern bool) ArithmExpr {
 	if p.next(); compact && p.spaced {
 		p.followErrExp(b.OpPos, b.Op.String())
 	}
+	p.deeper()
 	b.Y = p.arithmExpr(newLevel, compact, b.Op == Quest)
+	p.depth--
 	if b.Y == nil {
 		p.followErrExp(b.OpPos, b.Op.String())
 	}
@@ -939,6 +1060,8 @@ func isArithName(left ArithmExpr) bool {
 }
 
 func (p *Parser) arithmExprBase(compact bool) ArithmExpr {
+	p.deeper()
+	defer func() { p.depth-- }()
 	var x ArithmExpr
 	switch p.tok {
 	case exclMark:
@@ -1440,6 +1563,8 @@ func (p *Parser) getStmt(readEnd, binCmd, fnBody bool) (s *Stmt, gotEnd bool) {
 }
 
 func (p *Parser) gotStmtPipe(s *Stmt) *Stmt {
+	p.deeper()
+	defer func() { p.depth-- }()
 	if p.tok == _Newl {
 		p.next()
 		s.Position = p.pos
@@ -1857,7 +1982,10 @@ func (p *Parser) testExpr(ftok token, fpos Pos, pastAndOr bool) TestExpr {
 	switch b.Op {
 	case AndTest, OrTest:
 		p.next()
-		if b.Y = p.testExpr(token(b.Op), b.OpPos, false); b.Y == nil {
+		p.deeper()
+		b.Y = p.testExpr(token(b.Op), b.OpPos, false)
+		p.depth--
+		if b.Y == nil {
 			p.followErrExp(b.OpPos, b.Op.String())
 		}
 	case TsReMatch:
@@ -1879,6 +2007,8 @@ func (p *Parser) testExpr(ftok token, fpos Pos, pastAndOr bool) TestExpr {
 }
 
 func (p *Parser) testExprBase(ftok token, fpos Pos) TestExpr {
+	p.deeper()
+	defer func() { p.depth-- }()
 	switch p.tok {
 	case _EOF, rightParen:
 		return nil
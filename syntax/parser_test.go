@@ -1762,6 +1762,63 @@ func TestReadErr(t *testing.T) {
 	}
 }
 
+func TestParseLimits(t *testing.T) {
+	deep := func(n int, left, mid, right string) string {
+		return strings.Repeat(left, n) + mid + strings.Repeat(right, n)
+	}
+	tests := []struct {
+		opt       func(*Parser)
+		in        string
+		wantDepth bool
+		wantSize  bool
+	}{
+		{MaxDepth(100), deep(10, "( ", "foo", " )"), false, false},
+		{MaxDepth(100), deep(200, "( ", "foo", " )"), true, false},
+		{MaxDepth(100), deep(200, "{ ", "foo;", " }"), true, false},
+		{MaxDepth(100), deep(200, "$(", "foo", ")"), true, false},
+		{MaxDepth(100), deep(200, "\"${a:-", "foo", "}\""), true, false},
+		{MaxDepth(100), "echo $((" + deep(200, "(", "1", ")") + "))", true, false},
+		{MaxDepth(100), "echo $((" + strings.Repeat("- ", 200) + "1))", true, false},
+		{MaxDepth(100), "echo $((" + strings.Repeat("1+", 200) + "1))", true, false},
+		{MaxDepth(100), "[[ " + deep(200, "( ", "a", " )") + " ]]", true, false},
+		{MaxDepth(100), strings.Repeat("foo | ", 200) + "foo", true, false},
+		{MaxDepth(100), strings.Repeat("foo && ", 200) + "foo", false, false},
+		{MaxSize(10), "foo", false, false},
+		{MaxSize(10), "foo bar baz", false, true},
+		{MaxSize(100), strings.Repeat("foo\n", 1000), false, true},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			p := NewParser(tc.opt)
+			_, err := p.Parse(strings.NewReader(tc.in), "")
+			lerr, ok := err.(*LimitError)
+			if !tc.wantDepth && !tc.wantSize {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("want *LimitError, got %T: %v", err, err)
+			}
+			if lerr.Size != tc.wantSize {
+				t.Fatalf("wrong limit hit: %v", err)
+			}
+		})
+	}
+	p := NewParser(MaxDepth(10))
+	in := deep(20, "( ", "foo", " )")
+	_, err := p.Parse(strings.NewReader(in), "f.sh")
+	want := "f.sh:1:21: maximum nesting depth of 10 exceeded"
+	if err == nil || err.Error() != want {
+		t.Fatalf("Error mismatch in %q\nwant: %s\ngot:  %v", in, want, err)
+	}
+	// the parser should be reusable after hitting a limit
+	if _, err := p.Parse(strings.NewReader("( foo )"), ""); err != nil {
+		t.Fatalf("unexpected error after limit: %v", err)
+	}
+}
+
 type strictStringReader struct {
 	*strings.Reader
 	gaveEOF bool
@@ -1807,8 +1864,9 @@ func TestParseStmts(t *testing.T) {
 	recv := make(chan bool, 10)
 	errc := make(chan error)
 	go func() {
-		errc <- p.Stmts(cr, func(s *Stmt) {
+		errc <- p.Stmts(cr, func(s *Stmt) bool {
 			recv <- true
+			return true
 		})
 	}()
 	cr.cont <- true
@@ -1820,3 +1878,92 @@ func TestParseStmts(t *testing.T) {
 		t.Fatalf("Expected no error in %q: %v", in, err)
 	}
 }
+
+func TestParseStmtsStop(t *testing.T) {
+	in := "foo\nbar\nbaz; ("
+	p := NewParser()
+	var got []string
+	err := p.Stmts(strings.NewReader(in), func(s *Stmt) bool {
+		call := s.Cmd.(*CallExpr)
+		got = append(got, call.Args[0].Parts[0].(*Lit).Value)
+		return len(got) < 2
+	})
+	if err != nil {
+		t.Fatalf("Expected no error in %q: %v", in, err)
+	}
+	if want := []string{"foo", "bar"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("Stmts did not stop:\nwant: %q\ngot:  %q", want, got)
+	}
+	got = nil
+	err = p.Stmts(strings.NewReader(in), func(s *Stmt) bool {
+		got = append(got, "")
+		return true
+	})
+	if err == nil {
+		t.Fatalf("Expected error in %q", in)
+	}
+	if len(got) != 3 {
+		t.Fatalf("Stmts did not call fn before the error: %d calls", len(got))
+	}
+}
+
+func TestParseArithmetic(t *testing.T) {
+	tests := []struct {
+		in, want string // want is the error, if any
+	}{
+		{"(x+3)*2", ""},
+		{"a ? b : c", ""},
+		{"x++, y = $z + ${#w}", ""},
+		{"", "1:1: an arithmetic expression must not be empty"},
+		{"1 +", "1:3: + must be followed by an expression"},
+		{"1 2", "1:3: not a valid arithmetic operator: 2"},
+		{"a))", "1:2: not a valid arithmetic operator: )"},
+	}
+	p := NewParser()
+	for _, tc := range tests {
+		x, err := p.Arithmetic(strings.NewReader(tc.in))
+		if tc.want == "" {
+			if err != nil {
+				t.Fatalf("unexpected error in %q: %v", tc.in, err)
+			}
+			if x == nil {
+				t.Fatalf("nil expression in %q", tc.in)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.want {
+			t.Fatalf("wrong error in %q:\nwant: %s\ngot:  %v", tc.in, tc.want, err)
+		}
+	}
+}
+
+func TestParseTest(t *testing.T) {
+	tests := []struct {
+		in, want string // want is the error, if any
+	}{
+		{"-f foo", ""},
+		{"$a == b* && ! -z $c", ""},
+		{"(a < b) || x =~ ^[0-9]+$", ""},
+		{"", "1:1: a test expression must not be empty"},
+		{"a ]]", "1:3: not a valid test operator: ]]"},
+		{"a )", "1:3: not a valid test operator: )"},
+		{"a &&", "1:3: && must be followed by an expression"},
+		{"a foo b", "1:3: not a valid test operator: foo"},
+	}
+	p := NewParser()
+	for _, tc := range tests {
+		x, err := p.Test(strings.NewReader(tc.in))
+		if tc.want == "" {
+			if err != nil {
+				t.Fatalf("unexpected error in %q: %v", tc.in, err)
+			}
+			if x == nil {
+				t.Fatalf("nil expression in %q", tc.in)
+			}
+			continue
+		}
+		if err == nil || err.Error() != tc.want {
+			t.Fatalf("wrong error in %q:\nwant: %s\ngot:  %v", tc.in, tc.want, err)
+		}
+	}
+}
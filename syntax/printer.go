@@ -25,6 +25,34 @@ func BinaryNextLine(p *Printer) { p.binNextLine = true }
 // case bodies will be two levels deeper than the switch itself.
 func SwitchCaseIndent(p *Printer) { p.swtCaseIndent = true }
 
+// SpaceRedirects will put a space between redirection operators and
+// their words, such as in "> file". Duplications like ">&2" are left
+// as they are.
+func SpaceRedirects(p *Printer) { p.spaceRedirs = true }
+
+// RedirectsLast will move the redirections found among a command's
+// arguments to the end of the command, such as "foo bar >&2" instead of
+// "foo >&2 bar". Their order is kept.
+func RedirectsLast(p *Printer) { p.redirsLast = true }
+
+// FdStyle is the way in which the printer writes the file descriptors
+// of redirections that use the operator's default one, such as 1 in
+// "1>file" and 0 in "0<file". Here-documents and here-strings are
+// always left as they are.
+type FdStyle int
+
+const (
+	FdsAsWritten FdStyle = iota // keep the file descriptors as parsed
+	FdsOmitted                  // "1>&2" becomes ">&2"
+	FdsExplicit                 // ">&2" becomes "1>&2"
+)
+
+// RedirectFds sets the way in which the file descriptors of
+// redirections are written.
+func RedirectFds(style FdStyle) func(*Printer) {
+	return func(p *Printer) { p.redirFds = style }
+}
+
 // NewPrinter allocates a new Printer and applies any number of options.
 func NewPrinter(options ...func(*Printer)) *Printer {
 	p := &Printer{
@@ -62,6 +90,9 @@ type Printer struct {
 	indentSpaces  uint
 	binNextLine   bool
 	swtCaseIndent bool
+	spaceRedirs   bool
+	redirsLast    bool
+	redirFds      FdStyle
 
 	wantSpace   bool
 	wantNewline bool
@@ -553,15 +584,7 @@ func (p *Printer) stmt(s *Stmt) {
 		if r.OpPos.Line() > p.line {
 			p.bslashNewl()
 		}
-		if p.wantSpace {
-			p.WriteByte(' ')
-		}
-		if r.N != nil {
-			p.WriteString(r.N.Value)
-		}
-		p.WriteString(r.Op.String())
-		p.wantSpace = true
-		p.word(r.Word)
+		p.redirect(r)
 		if r.Op == Hdoc || r.Op == DashHdoc {
 			p.pendingHdocs = append(p.pendingHdocs, r)
 		}
@@ -580,6 +603,48 @@ func (p *Printer) stmt(s *Stmt) {
 	p.decLevel()
 }
 
+func (p *Printer) redirect(r *Redirect) {
+	if p.wantSpace {
+		p.WriteByte(' ')
+	}
+	fd := ""
+	if r.N != nil {
+		fd = r.N.Value
+	}
+	if def := defaultFd(r.Op); def != "" {
+		switch p.redirFds {
+		case FdsOmitted:
+			if fd == def {
+				fd = ""
+			}
+		case FdsExplicit:
+			if fd == "" {
+				fd = def
+			}
+		}
+	}
+	p.WriteString(fd)
+	p.WriteString(r.Op.String())
+	p.wantSpace = true
+	if p.spaceRedirs && r.Op != DplIn && r.Op != DplOut {
+		p.WriteByte(' ')
+		p.wantSpace = false
+	}
+	p.word(r.Word)
+}
+
+// defaultFd returns the file descriptor that a redirection operator
+// uses when none is given, if it may be written either way.
+func defaultFd(op RedirOperator) string {
+	switch op {
+	case RdrOut, AppOut, ClbOut, DplOut:
+		return "1"
+	case RdrIn, RdrInOut, DplIn:
+		return "0"
+	}
+	return ""
+}
+
 func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 	if p.wantSpace {
 		p.WriteByte(' ')
@@ -594,18 +659,11 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 		}
 		p.wordJoin(x.Args[:1])
 		for _, r := range redirs {
-			if r.Pos().After(x.Args[1].Pos()) || r.Op == Hdoc || r.Op == DashHdoc {
+			if p.redirsLast || r.Pos().After(x.Args[1].Pos()) ||
+				r.Op == Hdoc || r.Op == DashHdoc {
 				break
 			}
-			if p.wantSpace {
-				p.WriteByte(' ')
-			}
-			if r.N != nil {
-				p.WriteString(r.N.Value)
-			}
-			p.WriteString(r.Op.String())
-			p.wantSpace = true
-			p.word(r.Word)
+			p.redirect(r)
 			startRedirs++
 		}
 		p.wordJoin(x.Args[1:])
@@ -936,7 +994,10 @@ func (p *Printer) stmtCols(s *Stmt) int {
 		return -1 // stmtCols call within stmtCols, bail
 	}
 	*p.lenPrinter = Printer{
-		bufWriter: &p.lenCounter,
+		bufWriter:   &p.lenCounter,
+		spaceRedirs: p.spaceRedirs,
+		redirsLast:  p.redirsLast,
+		redirFds:    p.redirFds,
 	}
 	p.lenPrinter.bufWriter.Reset(nil)
 	p.lenPrinter.line = s.Pos().Line()
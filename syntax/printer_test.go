@@ -643,6 +643,77 @@ func TestPrintBinaryNextLine(t *testing.T) {
 	}
 }
 
+func TestPrintRedirects(t *testing.T) {
+	var tests = [...]struct {
+		opt      func(*Printer)
+		in, want string
+	}{
+		{
+			SpaceRedirects,
+			"foo >a 2>>b <c &>d >&2 <&3 <<<e",
+			"foo > a 2>> b < c &> d >&2 <&3 <<< e",
+		},
+		{
+			SpaceRedirects,
+			"foo <<EOF\nbar\nEOF",
+			"foo << EOF\nbar\nEOF",
+		},
+		{
+			SpaceRedirects,
+			"foo >(bar) < <(baz)",
+			"foo >(bar) < <(baz)",
+		},
+		{
+			RedirectsLast,
+			">&2 foo bar 2>/dev/null baz",
+			"foo bar baz >&2 2>/dev/null",
+		},
+		{
+			RedirectsLast,
+			"foo <<EOF bar\nl1\nEOF",
+			"foo bar <<EOF\nl1\nEOF",
+		},
+		{
+			RedirectFds(FdsOmitted),
+			"foo 1>a 0<b 1>&2 0<&3 2>c 1>>d 0<>e 0<<<f",
+			"foo >a <b >&2 <&3 2>c >>d <>e 0<<<f",
+		},
+		{
+			RedirectFds(FdsExplicit),
+			"foo >a <b >&2 <&3 2>c >>d &>e <<<f",
+			"foo 1>a 0<b 1>&2 0<&3 2>c 1>>d &>e <<<f",
+		},
+		{
+			func(p *Printer) {
+				SpaceRedirects(p)
+				RedirectsLast(p)
+				RedirectFds(FdsExplicit)(p)
+			},
+			"foo >x bar #c1\nfoo2 bar2 #c2",
+			"foo bar 1> x #c1\nfoo2 bar2    #c2",
+		},
+	}
+	parser := NewParser(KeepComments)
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(tc.opt)
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tc.want + "\n"
+			got, err := strPrint(printer, prog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("Print mismatch:\nin:\n%s\nwant:\n%sgot:\n%s",
+					tc.in, want, got)
+			}
+		})
+	}
+}
+
 func TestPrintSwitchCaseIndent(t *testing.T) {
 	var tests = [...]printCase{
 		{
@@ -0,0 +1,36 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "strings"
+
+// Quote returns a quoted version of s, which will be parsed back as a
+// single word whose value is s, without any expansions. If s does not
+// need quoting, it is returned as is. Otherwise, single quotes are
+// used.
+func Quote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if !needsQuoting(s) {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func needsQuoting(s string) bool {
+	for _, r := range s {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z',
+			'0' <= r && r <= '9':
+		default:
+			switch r {
+			case '_', '-', '+', '.', '/', ':', '@', '%', ',':
+			default:
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestQuote(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"", "''"},
+		{"foo", "foo"},
+		{"foo/bar.sh", "foo/bar.sh"},
+		{"-x", "-x"},
+		{"a b", "'a b'"},
+		{"it's", `'it'\''s'`},
+		{"'", `''\'''`},
+		{"$foo", "'$foo'"},
+		{"a\nb", "'a\nb'"},
+		{"*", "'*'"},
+		{"~", "'~'"},
+		{"a=b", "'a=b'"},
+		{"{a,b}", "'{a,b}'"},
+		{"世界", "'世界'"},
+	}
+	p := NewParser()
+	for _, tc := range tests {
+		got := Quote(tc.in)
+		if got != tc.want {
+			t.Errorf("Quote(%q) got %q, want %q", tc.in, got, tc.want)
+			continue
+		}
+		f, err := p.Parse(strings.NewReader("echo "+got), "")
+		if err != nil {
+			t.Errorf("Quote(%q) output does not parse: %v", tc.in, err)
+			continue
+		}
+		args := f.Stmts[0].Cmd.(*CallExpr).Args
+		if len(args) != 2 {
+			t.Errorf("Quote(%q) output is not a single word: %q", tc.in, got)
+			continue
+		}
+		var buf bytes.Buffer
+		for _, wp := range args[1].Parts {
+			switch x := wp.(type) {
+			case *Lit:
+				buf.WriteString(strings.Replace(x.Value, `\'`, "'", -1))
+			case *SglQuoted:
+				buf.WriteString(x.Value)
+			default:
+				t.Fatalf("Quote(%q) output has an unexpected part: %T", tc.in, x)
+			}
+		}
+		if buf.String() != tc.in {
+			t.Errorf("Quote(%q) output parses back as %q", tc.in, buf.String())
+		}
+	}
+}